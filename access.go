@@ -0,0 +1,78 @@
+package autoprof
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// An AuditRecord describes a request to a Handler.
+type AuditRecord struct {
+	// Time is when the request arrived, and Duration is how long the Handler
+	// took to respond.
+	Time     time.Time
+	Duration time.Duration
+
+	// Identity is the description of the caller that the Handler's Authorize
+	// function returned. It is empty when the Handler has no Authorize
+	// function, or when it rejected the request.
+	Identity string
+	// RemoteAddr is the network address of the caller, as in
+	// http.Request.RemoteAddr.
+	RemoteAddr string
+	// URL is the requested URL, including the query parameters that describe
+	// the bundle.
+	URL string
+
+	// Status is the HTTP status code of the response. For new bundles, the
+	// Handler sends the status before the collection begins, so a collection
+	// that fails partway may still have status 200.
+	Status int
+	// Err is the reason the Handler rejected the request or failed to
+	// complete the response, if any.
+	Err error
+}
+
+var (
+	errBearerToken     = errors.New("missing or incorrect bearer token")
+	errTooManyRequests = errors.New("too many concurrent profile bundle requests")
+)
+
+// BearerToken returns a function for the Authorize field of Handler which
+// accepts requests with an "Authorization" header of "Bearer " followed by the
+// provided token. It rejects every request if the token is empty.
+func BearerToken(token string) func(r *http.Request) (string, error) {
+	// Compare hashes, so the time the comparison takes does not depend on
+	// the length of the token.
+	want := sha256.Sum256([]byte("Bearer " + token))
+	return func(r *http.Request) (string, error) {
+		have := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		if token == "" || subtle.ConstantTimeCompare(have[:], want[:]) != 1 {
+			return "", errBearerToken
+		}
+		return "bearer token", nil
+	}
+}
+
+// statusWriter is an http.ResponseWriter which remembers the status code of
+// the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
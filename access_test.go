@@ -0,0 +1,170 @@
+package autoprof
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBearerToken(t *testing.T) {
+	for _, tt := range []struct {
+		token  string
+		header string
+		ok     bool
+	}{
+		{"s3cret", "Bearer s3cret", true},
+		{"s3cret", "Bearer s3cre", false},
+		{"s3cret", "Bearer s3cret2", false},
+		{"s3cret", "s3cret", false},
+		{"s3cret", "", false},
+		{"", "Bearer ", false},
+	} {
+		r := httptest.NewRequest("GET", "/debug/profiles", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		identity, err := BearerToken(tt.token)(r)
+		if have, want := err == nil, tt.ok; have != want {
+			t.Errorf("BearerToken(%q) with header %q; err = %v", tt.token, tt.header, err)
+		}
+		if err == nil && identity == "" {
+			t.Errorf("BearerToken(%q); empty identity", tt.token)
+		}
+	}
+}
+
+func TestHandlerAccess(t *testing.T) {
+	var mu sync.Mutex
+	var records []*AuditRecord
+	h := &Handler{
+		Authorize:     BearerToken("s3cret"),
+		MaxDuration:   10 * time.Second,
+		MaxConcurrent: 1,
+		Audit: func(rec *AuditRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			records = append(records, rec)
+		},
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(ctx context.Context, query, token string) int {
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+query, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest; err = %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0
+			}
+			t.Fatalf("http.Get; err = %v", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	ctx := context.Background()
+
+	if have, want := get(ctx, "?include=heap", ""), http.StatusUnauthorized; have != want {
+		t.Errorf("without token; status %d != %d", have, want)
+	}
+	if have, want := get(ctx, "?include=heap", "s3cret"), http.StatusOK; have != want {
+		t.Errorf("with token; status %d != %d", have, want)
+	}
+	if have, want := get(ctx, "?include=heap&profile=60s", "s3cret"), http.StatusBadRequest; have != want {
+		t.Errorf("long profile; status %d != %d", have, want)
+	}
+	if have, want := get(ctx, "?include=heap&trace=60s", "s3cret"), http.StatusBadRequest; have != want {
+		t.Errorf("long trace; status %d != %d", have, want)
+	}
+
+	// Hold the only slot with a request for a CPU profile, and then cancel it
+	// once the second request is rejected.
+	slowCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(slowCtx, "?include=heap&profile=5s", "s3cret")
+	}()
+	for h.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if have, want := get(ctx, "?include=heap", "s3cret"), http.StatusTooManyRequests; have != want {
+		t.Errorf("concurrent; status %d != %d", have, want)
+	}
+	// Each Handler has its own limit.
+	other := &Handler{MaxConcurrent: 1}
+	w := httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest("GET", "/debug/profiles?include=heap", nil))
+	if have, want := w.Code, http.StatusOK; have != want {
+		t.Errorf("concurrent on another Handler; status %d != %d", have, want)
+	}
+	cancel()
+	<-done
+
+	// The server calls the audit hook after the client sees the response.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := len(records)
+		mu.Unlock()
+		if n == 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	statuses := make(map[int]int)
+	for _, rec := range records {
+		statuses[rec.Status]++
+		if rec.Status == http.StatusUnauthorized {
+			if rec.Identity != "" || !errors.Is(rec.Err, errBearerToken) {
+				t.Errorf("rejected request; identity %q, err = %v", rec.Identity, rec.Err)
+			}
+			continue
+		}
+		if rec.Identity == "" {
+			t.Errorf("authorized request %q; no identity", rec.URL)
+		}
+		if rec.Status == http.StatusTooManyRequests && !errors.Is(rec.Err, errTooManyRequests) {
+			t.Errorf("concurrent request; err = %v", rec.Err)
+		}
+	}
+	if statuses[http.StatusUnauthorized] != 1 || statuses[http.StatusBadRequest] != 2 ||
+		statuses[http.StatusTooManyRequests] != 1 || statuses[http.StatusOK] != 2 {
+		t.Errorf("audit records; statuses %v", statuses)
+	}
+}
+
+func TestHandlerMaxDurationFlight(t *testing.T) {
+	// A request for a flight recorder snapshot ignores the "trace" parameter,
+	// so the limit doesn't apply to it.
+	h := &Handler{MaxDuration: 10 * time.Second, FlightRecorder: &FlightRecorder{}}
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"?include=heap&trace=60s", http.StatusBadRequest},
+		{"?include=heap&trace=60s&flight=1", http.StatusOK},
+		{"?include=heap&profile=60s&flight=1", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/profiles"+tt.query, nil))
+		if have, want := w.Code, tt.status; have != want {
+			t.Errorf("%s; status %d != %d", tt.query, have, want)
+		}
+	}
+}
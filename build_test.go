@@ -7,6 +7,8 @@ import (
 	"encoding/json"
 	"io/fs"
 	"os/exec"
+	"runtime"
+	"runtime/debug"
 	"strings"
 	"testing"
 
@@ -48,4 +50,25 @@ func TestCurrentArchiveMeta(t *testing.T) {
 	if !strings.HasSuffix(meta.Main, "/internal/test") {
 		t.Errorf("meta.Main: incorrect package name %q", meta.Main)
 	}
+	if meta.BuildID == "" {
+		t.Errorf("meta.BuildID: empty")
+	}
+	if meta.GOOS != runtime.GOOS || meta.GOARCH != runtime.GOARCH {
+		t.Errorf("meta.GOOS, meta.GOARCH: incorrect platform %s/%s", meta.GOOS, meta.GOARCH)
+	}
+	if meta.NumCPU <= 0 || meta.GOMAXPROCS <= 0 {
+		t.Errorf("meta.NumCPU, meta.GOMAXPROCS: %d, %d", meta.NumCPU, meta.GOMAXPROCS)
+	}
+
+	ibuf, err := fs.ReadFile(zr, "buildinfo")
+	if err != nil {
+		t.Fatalf("ReadFile(\"buildinfo\"): %v", err)
+	}
+	info, err := debug.ParseBuildInfo(string(ibuf))
+	if err != nil {
+		t.Fatalf("debug.ParseBuildInfo: %v", err)
+	}
+	if info.Path != meta.Main {
+		t.Errorf("buildinfo: path %q != %q", info.Path, meta.Main)
+	}
 }
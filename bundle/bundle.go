@@ -0,0 +1,281 @@
+// Package bundle reads the profile bundles that autoprof writes.
+//
+// A profile bundle is an uncompressed zip archive, as produced by
+// autoprof.NewZipCollector. The layout is described at
+// https://github.com/rhysh/autoprof/blob/main/README.md
+package bundle
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"runtime/debug"
+	"strings"
+
+	"github.com/rhysh/autoprof"
+)
+
+const (
+	metaName               = "meta"
+	buildInfoName          = "buildinfo"
+	expvarName             = "expvar"
+	errorsName             = "errors"
+	manifestName           = "manifest"
+	metricsName            = "runtime/metrics"
+	pprofDir               = "pprof/"
+	pprofDeltaDir          = "pprof-delta/"
+	pprofWindowsDir        = "pprof-windows/"
+	customDir              = "custom/"
+	profileName            = "pprof/profile"
+	traceName              = "pprof/trace"
+	tracePreviousName      = "pprof/trace-previous"
+	profileDuringTraceName = "pprof/profile-during-trace"
+)
+
+// A Bundle is a read-only view of a profile bundle.
+type Bundle struct {
+	// Meta describes the process that created the bundle, and when.
+	Meta autoprof.ArchiveMeta
+	// BuildInfo describes how the program was built, including its module
+	// dependencies. It is nil if the bundle does not include a "buildinfo"
+	// file.
+	BuildInfo *debug.BuildInfo
+	// Expvar holds the JSON-encoded expvar values, by key. It is nil if the
+	// bundle does not include an "expvar" file.
+	Expvar map[string]json.RawMessage
+
+	// Profiles lists the point-in-time runtime/pprof profiles, such as
+	// "heap" and "goroutine", in the order they appear in the bundle.
+	Profiles []*Entry
+	// DeltaProfiles lists the changes in the cumulative runtime/pprof
+	// profiles, such as "mutex", over the course of the collection, in the
+	// order they appear in the bundle.
+	DeltaProfiles []*Entry
+	// Custom lists the data from user-specified sources, in the order they
+	// appear in the bundle.
+	Custom []*Entry
+
+	// CPUProfile is the "pprof/profile" file, or nil if the bundle does not
+	// include a CPU profile.
+	CPUProfile *Entry
+	// ExecutionTrace is the "pprof/trace" file, or nil if the bundle does not
+	// include an execution trace.
+	ExecutionTrace *Entry
+	// ExecutionTracePrevious is the "pprof/trace-previous" file, or nil if the
+	// bundle does not include one. A flight recorder that runs the execution
+	// tracer in generations may store the generation before ExecutionTrace
+	// here, as a separate trace.
+	ExecutionTracePrevious *Entry
+	// CPUProfileDuringTrace is the "pprof/profile-during-trace" file, or nil
+	// if the bundle does not include one.
+	CPUProfileDuringTrace *Entry
+	// CPUProfileWindows lists the CPU profiles from a continuous profiler,
+	// in the order they appear in the bundle. The Name of each is its index.
+	// The bundle's Manifest records when each window started and ended.
+	CPUProfileWindows []*Entry
+
+	// Metrics holds snapshots of the runtime/metrics values from the start
+	// and end of the collection. It is nil if the bundle does not include a
+	// "runtime/metrics" file.
+	Metrics []*autoprof.MetricsSnapshot
+
+	// Errors lists the data sources that failed during collection of the
+	// bundle. It is nil if the bundle does not include an "errors" file.
+	Errors []*autoprof.EntryError
+
+	// Manifest describes the collection of each file in the bundle. It is nil
+	// if the bundle does not include a "manifest" file.
+	Manifest *autoprof.Manifest
+
+	// Entries lists every file in the bundle, in order.
+	Entries []*Entry
+}
+
+// An Entry is a single file within a profile bundle.
+type Entry struct {
+	// Path is the name of the file within the zip archive.
+	Path string
+	// Name is the name of the profile or data source that produced the file.
+	// For files in the "pprof/", "pprof-delta/", "pprof-windows/", and
+	// "custom/" directories, it is the remainder of the Path with URL
+	// path-escaping removed. For other files, it is equal to Path.
+	Name string
+	// Size is the length of the file's contents, in bytes.
+	Size int64
+
+	file *zip.File
+}
+
+// Open returns an io.ReadCloser for the contents of the entry.
+func (e *Entry) Open() (io.ReadCloser, error) {
+	return e.file.Open()
+}
+
+// ReadAll returns the contents of the entry.
+func (e *Entry) ReadAll() ([]byte, error) {
+	rc, err := e.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Open parses the profile bundle of the provided size which r holds.
+func Open(r io.ReaderAt, size int64) (*Bundle, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("bundle: %w", err)
+	}
+
+	b := &Bundle{}
+	var meta, buildInfo, expvar, metrics, errs, manifest *Entry
+	for _, file := range zr.File {
+		e := &Entry{
+			Path: file.Name,
+			Name: file.Name,
+			Size: int64(file.UncompressedSize64),
+			file: file,
+		}
+		b.Entries = append(b.Entries, e)
+
+		switch {
+		case e.Path == metaName:
+			meta = e
+		case e.Path == buildInfoName:
+			buildInfo = e
+		case e.Path == expvarName:
+			expvar = e
+		case e.Path == metricsName:
+			metrics = e
+		case e.Path == errorsName:
+			errs = e
+		case e.Path == manifestName:
+			manifest = e
+		case e.Path == profileName:
+			b.CPUProfile = e
+		case e.Path == traceName:
+			b.ExecutionTrace = e
+		case e.Path == tracePreviousName:
+			b.ExecutionTracePrevious = e
+		case e.Path == profileDuringTraceName:
+			b.CPUProfileDuringTrace = e
+		case strings.HasPrefix(e.Path, pprofDir):
+			e.Name, err = url.PathUnescape(strings.TrimPrefix(e.Path, pprofDir))
+			if err != nil {
+				return nil, fmt.Errorf("bundle: file %q: %w", e.Path, err)
+			}
+			b.Profiles = append(b.Profiles, e)
+		case strings.HasPrefix(e.Path, pprofDeltaDir):
+			e.Name, err = url.PathUnescape(strings.TrimPrefix(e.Path, pprofDeltaDir))
+			if err != nil {
+				return nil, fmt.Errorf("bundle: file %q: %w", e.Path, err)
+			}
+			b.DeltaProfiles = append(b.DeltaProfiles, e)
+		case strings.HasPrefix(e.Path, pprofWindowsDir):
+			e.Name, err = url.PathUnescape(strings.TrimPrefix(e.Path, pprofWindowsDir))
+			if err != nil {
+				return nil, fmt.Errorf("bundle: file %q: %w", e.Path, err)
+			}
+			b.CPUProfileWindows = append(b.CPUProfileWindows, e)
+		case strings.HasPrefix(e.Path, customDir):
+			e.Name, err = url.PathUnescape(strings.TrimPrefix(e.Path, customDir))
+			if err != nil {
+				return nil, fmt.Errorf("bundle: file %q: %w", e.Path, err)
+			}
+			b.Custom = append(b.Custom, e)
+		}
+	}
+
+	if meta == nil {
+		return nil, fmt.Errorf("bundle: file %q: %w", metaName, fs.ErrNotExist)
+	}
+	err = decodeJSON(meta, &b.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if buildInfo != nil {
+		buf, err := buildInfo.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("bundle: file %q: %w", buildInfo.Path, err)
+		}
+		b.BuildInfo, err = debug.ParseBuildInfo(string(buf))
+		if err != nil {
+			return nil, fmt.Errorf("bundle: file %q: %w", buildInfo.Path, err)
+		}
+	}
+
+	if expvar != nil {
+		err = decodeJSON(expvar, &b.Expvar)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if metrics != nil {
+		err = decodeJSON(metrics, &b.Metrics)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if errs != nil {
+		err = decodeJSON(errs, &b.Errors)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest != nil {
+		b.Manifest = new(autoprof.Manifest)
+		err = decodeJSON(manifest, b.Manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Profile returns the point-in-time runtime/pprof profile with the provided
+// name, or nil if the bundle does not include it.
+func (b *Bundle) Profile(name string) *Entry {
+	return find(b.Profiles, name)
+}
+
+// DeltaProfile returns the change in the cumulative runtime/pprof profile with
+// the provided name, or nil if the bundle does not include it.
+func (b *Bundle) DeltaProfile(name string) *Entry {
+	return find(b.DeltaProfiles, name)
+}
+
+// CustomData returns the data from the user-specified source with the provided
+// name, or nil if the bundle does not include it.
+func (b *Bundle) CustomData(name string) *Entry {
+	return find(b.Custom, name)
+}
+
+func find(entries []*Entry, name string) *Entry {
+	for _, e := range entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func decodeJSON(e *Entry, v interface{}) error {
+	buf, err := e.ReadAll()
+	if err != nil {
+		return fmt.Errorf("bundle: file %q: %w", e.Path, err)
+	}
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return fmt.Errorf("bundle: file %q: %w", e.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package bundle_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	meta := autoprof.CurrentArchiveMeta()
+
+	var buf bytes.Buffer
+	err := autoprof.NewZipCollector(&buf, meta, &autoprof.ArchiveOptions{
+		CPUProfileDuration: 100 * time.Millisecond,
+		DeltaProfiles:      true,
+		CustomDataSources: map[string]*autoprof.DataSource{
+			"greeting/en": {WriteTo: func(ctx context.Context, w io.Writer) error {
+				_, err := io.WriteString(w, "hello")
+				return err
+			}},
+		},
+	}).Run(ctx)
+	if err != nil {
+		t.Fatalf("autoprof.NewZipCollector.Run; err = %v", err)
+	}
+
+	b, err := bundle.Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("bundle.Open; err = %v", err)
+	}
+
+	if have, want := b.Meta, *meta; have != want {
+		t.Errorf("Meta; %#v != %#v", have, want)
+	}
+	if b.BuildInfo == nil || b.BuildInfo.Path != meta.Main {
+		t.Errorf("BuildInfo; does not describe %q", meta.Main)
+	}
+	if _, ok := b.Expvar["cmdline"]; !ok {
+		t.Errorf("Expvar; cmdline value not present")
+	}
+
+	if len(b.Profiles) == 0 || b.Profiles[0].Name != "heap" {
+		t.Errorf("Profiles; heap profile is not first")
+	}
+	if b.Profile("goroutine") == nil {
+		t.Errorf("Profile(%q); not found", "goroutine")
+	}
+
+	if b.DeltaProfile("mutex") == nil {
+		t.Errorf("DeltaProfile(%q); not found", "mutex")
+	}
+
+	if have, want := len(b.Metrics), 2; have != want {
+		t.Errorf("Metrics; %d snapshots != %d", have, want)
+	}
+
+	custom := b.CustomData("greeting/en")
+	if custom == nil {
+		t.Fatalf("CustomData(%q); not found", "greeting/en")
+	}
+	if have, want := custom.Path, "custom/greeting%2Fen"; have != want {
+		t.Errorf("CustomData(%q).Path; %q != %q", "greeting/en", have, want)
+	}
+	data, err := custom.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll; err = %v", err)
+	}
+	if have, want := string(data), "hello"; have != want {
+		t.Errorf("ReadAll; %q != %q", have, want)
+	}
+
+	if b.CPUProfile == nil {
+		t.Errorf("CPUProfile; not found")
+	}
+	if b.ExecutionTrace != nil {
+		t.Errorf("ExecutionTrace; found unexpected trace")
+	}
+
+	if b.Manifest == nil {
+		t.Fatalf("Manifest; not found")
+	}
+	if have, want := len(b.Manifest.Entries), len(b.Entries)-1; have != want {
+		t.Errorf("Manifest; %d entries != %d", have, want)
+	}
+	if b.CPUProfileDuringTrace != nil {
+		t.Errorf("CPUProfileDuringTrace; found unexpected profile")
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	t.Run("not a zip", func(t *testing.T) {
+		buf := []byte("hello")
+		_, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+		if err == nil {
+			t.Errorf("bundle.Open; expected error")
+		}
+	})
+
+	t.Run("no meta", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		_, err := zw.Create("expvar")
+		if err != nil {
+			t.Fatalf("zip.Writer.Create; err = %v", err)
+		}
+		err = zw.Close()
+		if err != nil {
+			t.Fatalf("zip.Writer.Close; err = %v", err)
+		}
+		_, err = bundle.Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("bundle.Open; err = %v, expected fs.ErrNotExist", err)
+		}
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"runtime/pprof"
@@ -47,11 +49,124 @@ type ArchiveOptions struct {
 	// no limit.
 	ExecutionTraceByteTarget int64
 
+	// CPUProfileWindows holds CPU profiles that were collected before the
+	// profile bundle, such as by a continuous profiler. Each is stored in a
+	// file named "pprof-windows/" followed by its index in this list. The
+	// manifest entry for each file records the start and end of that CPU
+	// profile, so the windows can be stitched together.
+	CPUProfileWindows []*ProfileWindow
+
+	// FlightRecorder, if set, provides the profile bundle's execution trace
+	// in place of a new one of ExecutionTraceDuration. The collector takes a
+	// snapshot of the flight recorder's recent history when it starts, and
+	// stores it as "pprof/trace". The manifest entry for that file records the
+	// approximate times that the trace covers.
+	FlightRecorder *FlightRecorder
+
 	// CustomDataSources holds user-specified additional data sources. When
 	// generating a zip-archived profile bundle, data from these sources will
 	// be included in the "custom/" directory. The map key names will be URI
 	// path-escaped and used to name the files within that directory.
 	CustomDataSources map[string]*DataSource
+
+	// IncludeProfiles optionally lists the names of the runtime/pprof
+	// profiles, such as "heap" and "goroutine", to include in the profile
+	// bundle, along with any of the built-in data sources that are selected
+	// the same way ("runtime/metrics"). When it is empty, the bundle includes
+	// every profile that runtime/pprof.Profiles returns, and every one of
+	// those data sources.
+	IncludeProfiles []string
+	// ExcludeProfiles lists the names of runtime/pprof profiles and built-in
+	// data sources to omit from the profile bundle, such as "allocs" (which
+	// holds the same data as "heap"). It takes precedence over
+	// IncludeProfiles.
+	ExcludeProfiles []string
+	// ProfileDebug holds the "debug" parameter to use when writing out each
+	// runtime/pprof profile, by name. Profiles that are not listed use the
+	// protobuf encoding, debug=0.
+	ProfileDebug map[string]int
+
+	// DeltaProfiles requests that the profile bundle include the change in
+	// each of the cumulative runtime/pprof profiles ("heap", "allocs",
+	// "block", and "mutex") over the course of the CPU profile and execution
+	// trace. The collector takes a snapshot of those profiles before it starts
+	// the CPU profile and execution trace, and another after they finish. It
+	// stores the difference in files named "pprof-delta/" followed by the
+	// profile's path-escaped name. It honors IncludeProfiles and
+	// ExcludeProfiles.
+	DeltaProfiles bool
+	// DeltaBase is an optional earlier snapshot of the cumulative profiles,
+	// such as from the DeltaSnapshot method of a previous Collector. When set,
+	// the delta profiles describe the change from that snapshot, rather than
+	// from the start of the CPU profile and execution trace.
+	DeltaBase *ProfileSnapshot
+
+	// RecordErrors requests that the collector isolate failures of individual
+	// data sources. When set, an error from a data source (such as one of the
+	// CustomDataSources, or a runtime/pprof profile) is recorded in a JSON-
+	// encoded file named "errors" at the end of the profile bundle and
+	// collection continues with the remaining sources. Only errors from the
+	// underlying io.Writer cause the collection to fail.
+	//
+	// When unset, the first error from any data source causes the collection
+	// to fail.
+	RecordErrors bool
+
+	// Priority describes the collector's claim on the process's CPU profiler
+	// and execution tracer, relative to other users of DefaultCoordinator.
+	Priority Priority
+	// ProfilerWait is an optional limit on how long the collector will wait
+	// for DefaultCoordinator to make the CPU profiler and execution tracer
+	// available. When it is unset, the collector will wait for as long as the
+	// context allows.
+	ProfilerWait time.Duration
+}
+
+// DefaultArchiveOptions returns the options for a profile bundle that someone
+// asked for, such as in response to a signal or an alert: a five-second CPU
+// profile, collected with interactive priority so it takes the profilers from
+// any scheduled collection, waiting up to ten seconds for them. It sets
+// RecordErrors, so the bundle includes as much data as possible even if some
+// sources fail. Each call returns a new value, which the caller may modify.
+func DefaultArchiveOptions() *ArchiveOptions {
+	return &ArchiveOptions{
+		CPUProfileDuration: 5 * time.Second,
+		RecordErrors:       true,
+		Priority:           PriorityInteractive,
+		ProfilerWait:       10 * time.Second,
+	}
+}
+
+// includeProfile reports whether the profile bundle should include the
+// runtime/pprof profile with the provided name.
+func (opt *ArchiveOptions) includeProfile(name string) bool {
+	for _, v := range opt.ExcludeProfiles {
+		if v == name {
+			return false
+		}
+	}
+	if len(opt.IncludeProfiles) == 0 {
+		return true
+	}
+	for _, v := range opt.IncludeProfiles {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// An EntryError describes a data source that failed while writing its portion
+// of a profile bundle. In zip-archived profile bundles, a list of these will be
+// JSON-encoded and stored as a file named "errors".
+type EntryError struct {
+	// Name is the name of the file within the profile bundle.
+	Name string `json:"name"`
+	// Error is the text of the error the data source returned.
+	Error string `json:"error"`
+	// BytesWritten is the number of bytes the data source wrote to the file
+	// before it failed.
+	BytesWritten int64 `json:"bytes_written"`
 }
 
 // A DataSource can generate data to be included in a profile bundle.
@@ -72,6 +187,14 @@ type Collector struct {
 	// addErr holds onto any error encountered while calling the add method
 	// for delayed processing.
 	addErr error
+	// entryErrs lists the data sources that failed, when the RecordErrors
+	// option is set.
+	entryErrs []*EntryError
+	// manifest describes the files written to the profile bundle so far.
+	manifest Manifest
+	// deltaEnd is the snapshot of the cumulative profiles at the end of the
+	// collection, when the DeltaProfiles option is set.
+	deltaEnd *ProfileSnapshot
 }
 
 // add stores the data from source into the profile bundle, using the provided
@@ -84,12 +207,91 @@ func (c *Collector) add(ctx context.Context, name string, source *DataSource) {
 	if c.addErr != nil {
 		return
 	}
-	var w io.Writer
-	w, c.addErr = c.writeFileHeader(name)
-	if c.addErr != nil {
+	w, err := c.createEntry(name)
+	if err != nil {
+		c.addErr = err
+		return
+	}
+	err = source.WriteTo(ctx, w)
+	w.rec.End = time.Now()
+	if err == nil {
+		return
+	}
+	if w.err != nil || !c.opt.RecordErrors {
+		// The failure may have left the profile bundle in an inconsistent
+		// state, or the user has asked us not to continue.
+		c.addErr = err
+		return
+	}
+	c.entryErrs = append(c.entryErrs, &EntryError{
+		Name:         name,
+		Error:        err.Error(),
+		BytesWritten: w.rec.Bytes,
+	})
+}
+
+// fail records an error that did not result in a record in the profile
+// bundle, following the same policy as the add method.
+func (c *Collector) fail(name string, err error) {
+	if !c.opt.RecordErrors {
+		if c.addErr == nil {
+			c.addErr = err
+		}
 		return
 	}
-	c.addErr = source.WriteTo(ctx, w)
+	c.entryErrs = append(c.entryErrs, &EntryError{
+		Name:  name,
+		Error: err.Error(),
+	})
+}
+
+// createEntry prepares the profile bundle to receive data for a record with
+// the provided name, returning an io.Writer that tracks the outcome of writes
+// to that record. The caller is responsible for setting the End time of the
+// record's manifest entry.
+func (c *Collector) createEntry(name string) (*entryWriter, error) {
+	w, err := c.writeFileHeader(name)
+	if err != nil {
+		return nil, err
+	}
+	rec := &ManifestEntry{Name: name, Start: time.Now()}
+	c.manifest.Entries = append(c.manifest.Entries, rec)
+	return &entryWriter{wr: w, rec: rec}, nil
+}
+
+// skip notes that the collector was unable to start the time-based profile
+// with the provided name.
+func (c *Collector) skip(name string, requested time.Duration, reason SkipReason, err error) {
+	c.manifest.Skipped = append(c.manifest.Skipped, &SkippedProfile{
+		Name:              name,
+		RequestedDuration: requested,
+		Reason:            reason,
+		Error:             err.Error(),
+	})
+}
+
+// DeltaSnapshot returns the snapshot of the cumulative runtime/pprof profiles
+// that the Collector took at the end of its time-based profiles, for use as
+// the DeltaBase of a later collection. It is nil unless the DeltaProfiles
+// option is set, and is available once Run returns.
+func (c *Collector) DeltaSnapshot() *ProfileSnapshot {
+	return c.deltaEnd
+}
+
+// Manifest returns a description of the work the Collector did to assemble the
+// profile bundle, including any time-based profiles it was unable to include.
+// It is complete once Run returns.
+func (c *Collector) Manifest() *Manifest {
+	return &c.manifest
+}
+
+// writeManifest adds the manifest as the final file in the profile bundle.
+func (c *Collector) writeManifest(ctx context.Context) error {
+	w, err := c.writeFileHeader("manifest")
+	if err != nil {
+		return err
+	}
+	return jsonSource(&c.manifest).WriteTo(ctx, w)
 }
 
 // Run collects the specified profile bundle.
@@ -97,15 +299,26 @@ func (c *Collector) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Capture the flight recorder's history first, so it ends as close as
+	// possible to the moment that prompted this profile bundle.
+	var flight *flightSnapshot
+	var flightErr error
+	if c.opt.FlightRecorder != nil {
+		flight, flightErr = c.opt.FlightRecorder.snapshot()
+	}
+
 	c.add(ctx, "meta", metaSource(c.meta))
+	c.add(ctx, "buildinfo", buildInfoSource())
 	c.add(ctx, "expvar", expvarSource())
 
 	// write heap profile first, so it's in a consistent position
-	c.add(ctx, "pprof/heap", pprofSource(pprof.Lookup("heap")))
+	if c.opt.includeProfile("heap") {
+		c.add(ctx, "pprof/heap", pprofSource(pprof.Lookup("heap"), c.opt.ProfileDebug["heap"]))
+	}
 
 	for _, profile := range pprof.Profiles() {
-		if name := profile.Name(); name != "heap" {
-			c.add(ctx, "pprof/"+url.PathEscape(name), pprofSource(profile))
+		if name := profile.Name(); name != "heap" && c.opt.includeProfile(name) {
+			c.add(ctx, "pprof/"+url.PathEscape(name), pprofSource(profile, c.opt.ProfileDebug[name]))
 		}
 	}
 
@@ -122,30 +335,183 @@ func (c *Collector) Run(ctx context.Context) error {
 		return c.addErr
 	}
 
+	timeBased := c.opt.CPUProfileDuration > 0 || c.traceDuration() > 0
+
+	// Record the state of the runtime before and after the time-based
+	// profiles, so the bundle can show the rates at which things change.
+	var metrics *metricsSource
+	if c.opt.includeProfile(metricsSourceName) {
+		metrics = &metricsSource{}
+		metrics.take()
+	}
+
+	var deltaBase *ProfileSnapshot
+	if c.opt.DeltaProfiles {
+		deltaBase = c.opt.DeltaBase
+		if deltaBase == nil && timeBased {
+			deltaBase = c.snapshotProfiles()
+		}
+	}
+
+	if c.opt.FlightRecorder != nil {
+		c.addFlightRecording(flight, flightErr)
+		if c.addErr != nil {
+			return c.addErr
+		}
+	}
+	err := c.addTimeBasedProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	c.addCPUProfileWindows()
+
+	if metrics != nil && timeBased {
+		metrics.take()
+	}
+
+	if c.opt.DeltaProfiles && c.addErr == nil {
+		c.deltaEnd = c.snapshotProfiles()
+		if deltaBase != nil {
+			c.addDeltaProfiles(ctx, deltaBase, c.deltaEnd)
+		}
+	}
+
+	if metrics != nil {
+		c.add(ctx, metricsSourceName, &DataSource{WriteTo: metrics.WriteTo})
+	}
+	if c.addErr != nil {
+		return c.addErr
+	}
+
+	if len(c.entryErrs) > 0 {
+		c.add(ctx, "errors", jsonSource(c.entryErrs))
+		if c.addErr != nil {
+			return c.addErr
+		}
+	}
+
+	err = c.writeManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.finish()
+}
+
+// addTimeBasedProfiles claims the process's profilers from DefaultCoordinator
+// and uses them to add the requested CPU profile and execution trace.
+func (c *Collector) addTimeBasedProfiles(ctx context.Context) error {
+	const (
+		profileName            = "pprof/profile"
+		traceName              = "pprof/trace"
+		profileDuringTraceName = "pprof/profile-during-trace"
+	)
+
+	var profilers Profiler
 	if c.opt.CPUProfileDuration > 0 {
-		err := c.addCPUProfile(ctx, "pprof/profile")
+		profilers |= CPUProfiler
+	}
+	if c.traceDuration() > 0 {
+		profilers |= ExecutionTracer
+	}
+	if profilers == 0 {
+		return nil
+	}
+
+	lease, err := func() (*Lease, error) {
+		ctx := ctx
+		if c.opt.ProfilerWait > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.opt.ProfilerWait)
+			defer cancel()
+		}
+		return DefaultCoordinator.Acquire(ctx, profilers, c.opt.Priority)
+	}()
+	if err != nil {
+		reason := SkipWaitExpired
+		if ctx.Err() != nil {
+			reason = SkipCanceled
+		}
+		err = fmt.Errorf("waiting for profiler: %w", err)
+		if profilers&CPUProfiler != 0 {
+			c.skip(profileName, c.opt.CPUProfileDuration, reason, err)
+		}
+		if profilers&ExecutionTracer != 0 {
+			c.skip(traceName, c.opt.ExecutionTraceDuration, reason, err)
+		}
+		return nil
+	}
+	defer lease.Release()
+
+	// Stop profiling promptly if a higher-priority request needs the
+	// profilers.
+	heldCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-heldCtx.Done():
+		case <-lease.Preempted():
+			cancel()
+		}
+	}()
+
+	if c.opt.CPUProfileDuration > 0 {
+		rec, err := c.addCPUProfile(heldCtx, profileName)
 		if err != nil {
 			return err
 		}
+		c.checkPreempted(ctx, rec)
 	}
 
-	if c.opt.ExecutionTraceDuration > 0 {
-		err := c.addExecutionTrace(ctx, "pprof/trace", "pprof/profile-during-trace")
+	if c.traceDuration() > 0 {
+		if heldCtx.Err() != nil && ctx.Err() == nil {
+			c.skip(traceName, c.opt.ExecutionTraceDuration, SkipPreempted, errPreempted)
+			return nil
+		}
+		recs, err := c.addExecutionTrace(heldCtx, traceName, profileDuringTraceName)
 		if err != nil {
 			return err
 		}
+		c.checkPreempted(ctx, recs...)
 	}
 
-	return c.finish()
+	return nil
+}
+
+// traceDuration returns the duration of the new execution trace to include in
+// the profile bundle. It's zero when the bundle's trace comes from a flight
+// recorder.
+func (c *Collector) traceDuration() time.Duration {
+	if c.opt.FlightRecorder != nil {
+		return 0
+	}
+	return c.opt.ExecutionTraceDuration
+}
+
+var errPreempted = errors.New("preempted by a higher-priority request")
+
+// checkPreempted updates the stop reason for time-based profiles that ended
+// early even though the collection's context was still active, which means
+// that DefaultCoordinator preempted them.
+func (c *Collector) checkPreempted(ctx context.Context, recs ...*ManifestEntry) {
+	if ctx.Err() != nil {
+		return
+	}
+	for _, rec := range recs {
+		if rec != nil && rec.StopReason == StopCanceled {
+			rec.StopReason = StopPreempted
+		}
+	}
 }
 
-func (c *Collector) addCPUProfile(ctx context.Context, name string) error {
+func (c *Collector) addCPUProfile(ctx context.Context, name string) (*ManifestEntry, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.opt.CPUProfileDuration)
 	defer cancel()
-	return c.addTimeBasedProfile(ctx, name, c.opt.CPUProfileByteTarget, pprof.StartCPUProfile, pprof.StopCPUProfile)
+	return c.addTimeBasedProfile(ctx, name, c.opt.CPUProfileDuration, c.opt.CPUProfileByteTarget,
+		pprof.StartCPUProfile, pprof.StopCPUProfile)
 }
 
-func (c *Collector) addExecutionTrace(ctx context.Context, name, profileName string) error {
+func (c *Collector) addExecutionTrace(ctx context.Context, name, profileName string) ([]*ManifestEntry, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.opt.ExecutionTraceDuration)
 	defer cancel()
 
@@ -153,6 +519,7 @@ func (c *Collector) addExecutionTrace(ctx context.Context, name, profileName str
 	stop := trace.Stop
 
 	var cpuProfile *bytes.Buffer
+	var cpuProfileErr error
 
 	if c.opt.CPUProfileDuration > 0 {
 		// CPU profiles are enabled for this bundle. Run a CPU profile that
@@ -165,11 +532,19 @@ func (c *Collector) addExecutionTrace(ctx context.Context, name, profileName str
 			// only writes out data during the StopCPUProfile call, so there's
 			// no use in streaming the data to enforce a soft limit on its size.
 			var buf bytes.Buffer
-			if err := pprof.StartCPUProfile(&buf); err == nil {
+			cpuProfileErr = pprof.StartCPUProfile(&buf)
+			if cpuProfileErr == nil {
 				cpuProfile = &buf
 			}
 
-			return trace.Start(w)
+			err := trace.Start(w)
+			if err != nil && cpuProfile != nil {
+				// Without an execution trace, there's no reason to keep the
+				// CPU profile running.
+				pprof.StopCPUProfile()
+				cpuProfile = nil
+			}
+			return err
 		}
 		stop = func() {
 			trace.Stop()
@@ -183,54 +558,78 @@ func (c *Collector) addExecutionTrace(ctx context.Context, name, profileName str
 		}
 	}
 
-	traceErr := c.addTimeBasedProfile(ctx, name, c.opt.ExecutionTraceByteTarget, start, stop)
+	traceRec, traceErr := c.addTimeBasedProfile(ctx, name, c.opt.ExecutionTraceDuration, c.opt.ExecutionTraceByteTarget,
+		start, stop)
+	if traceRec != nil && cpuProfileErr != nil {
+		c.skip(profileName, c.opt.ExecutionTraceDuration, SkipBusy, cpuProfileErr)
+	}
 
+	var profileRec *ManifestEntry
 	profileErr := func() error {
-		if cpuProfile == nil {
+		if cpuProfile == nil || traceRec == nil {
 			return nil
 		}
-		w, err := c.writeFileHeader(profileName)
+		w, err := c.createEntry(profileName)
 		if err != nil {
 			return err
 		}
+		// The CPU profile covers the same time window as the execution trace.
+		profileRec = w.rec
+		profileRec.Start, profileRec.StopReason = traceRec.Start, traceRec.StopReason
+		profileRec.RequestedDuration = traceRec.RequestedDuration
 		_, err = io.Copy(w, cpuProfile)
+		profileRec.End = traceRec.End
 		return err
 	}()
 
+	recs := []*ManifestEntry{traceRec, profileRec}
 	if traceErr != nil {
-		return traceErr
+		return recs, traceErr
 	}
-	return profileErr
+	return recs, profileErr
 }
 
-func (c *Collector) addTimeBasedProfile(ctx context.Context, name string, targetSize int64,
-	start func(w io.Writer) error, stop func()) error {
+// addTimeBasedProfile runs a profile until ctx is done or until its output
+// reaches the target size, storing the data in the profile bundle with the
+// provided name. It returns the profile's manifest entry, or nil if the
+// profile could not start.
+func (c *Collector) addTimeBasedProfile(ctx context.Context, name string, requested time.Duration, targetSize int64,
+	start func(w io.Writer) error, stop func()) (*ManifestEntry, error) {
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	pr, pw := io.Pipe()
 
+	startTime := time.Now()
 	err := start(pw)
 	if err != nil {
 		// A profile is already in progress, such as by an interactive request
 		// to /debug/pprof/{profile,trace}
 		//
-		// Skip this part of the debug bundle collection.
-		return nil
+		// Skip this part of the debug bundle collection, noting why.
+		c.skip(name, requested, SkipBusy, err)
+		return nil, nil
 	}
 
 	// Now that we know we'll have data, prepare to add it to the profile
 	// bundle.
-	w, err := c.writeFileHeader(name)
+	ew, err := c.createEntry(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	ew.rec.Start = startTime
+	ew.rec.RequestedDuration = requested
 
+	var w io.Writer = ew
+	triggered := false
 	if targetSize > 0 {
 		w = &limitTriggerWriter{
-			wr:        w,
-			fn:        cancel,
+			wr: w,
+			fn: func() {
+				triggered = true
+				cancel()
+			},
 			remaining: targetSize,
 		}
 	}
@@ -244,7 +643,9 @@ func (c *Collector) addTimeBasedProfile(ctx context.Context, name string, target
 	}()
 
 	<-ctx.Done()
+	doneErr := ctx.Err()
 	stop()
+	ew.rec.End = time.Now()
 
 	closeErr := pw.Close()
 	wg.Wait()
@@ -253,7 +654,16 @@ func (c *Collector) addTimeBasedProfile(ctx context.Context, name string, target
 		err = closeErr
 	}
 
-	return err
+	switch {
+	case doneErr == context.DeadlineExceeded:
+		ew.rec.StopReason = StopDuration
+	case triggered:
+		ew.rec.StopReason = StopByteTarget
+	default:
+		ew.rec.StopReason = StopCanceled
+	}
+
+	return ew.rec, err
 }
 
 type limitTriggerWriter struct {
@@ -271,3 +681,20 @@ func (lw *limitTriggerWriter) Write(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// entryWriter counts the bytes written to a record in the profile bundle, and
+// remembers the first error from the underlying io.Writer.
+type entryWriter struct {
+	wr  io.Writer
+	rec *ManifestEntry
+	err error
+}
+
+func (ew *entryWriter) Write(p []byte) (int, error) {
+	n, err := ew.wr.Write(p)
+	ew.rec.Bytes += int64(n)
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+	return n, err
+}
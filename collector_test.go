@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -54,6 +55,19 @@ func TestZipCollector(t *testing.T) {
 		}
 	})
 
+	t.Run("profile selection", func(t *testing.T) {
+		zr, err := collect(ctx, meta, &autoprof.ArchiveOptions{
+			ExcludeProfiles: []string{"heap", "allocs", "threadcreate"},
+		})
+		if err != nil {
+			t.Fatalf("collect; err = %v", err)
+		}
+		checkNotExist(t, zr, "pprof/heap")
+		checkNotExist(t, zr, "pprof/allocs")
+		checkNotExist(t, zr, "pprof/threadcreate")
+		checkExist(t, zr, "pprof/goroutine")
+	})
+
 	t.Run("profile only", func(t *testing.T) {
 		if profileIsEnabled() {
 			t.Skip("a CPU profile is already active")
@@ -171,6 +185,9 @@ func TestZipCollector(t *testing.T) {
 		checkNotExist(t, zr, profileName)
 		checkExist(t, zr, traceName)
 		checkNotExist(t, zr, profileDuringTraceName)
+
+		// The bundle should explain why it lacks the CPU profiles.
+		checkSkipped(t, readManifest(t, zr), autoprof.SkipBusy, profileName, profileDuringTraceName)
 	})
 
 	t.Run("trace already running", func(t *testing.T) {
@@ -208,6 +225,220 @@ func TestZipCollector(t *testing.T) {
 		checkNotExist(t, zr, profileDuringTraceName)
 	})
 
+	t.Run("skipped trace", func(t *testing.T) {
+		if trace.IsEnabled() {
+			t.Skip("an execution trace is already active")
+		}
+		defer func() {
+			if trace.IsEnabled() {
+				t.Errorf("an execution trace remained active")
+			}
+		}()
+
+		err := trace.Start(io.Discard)
+		defer func() {
+			if !trace.IsEnabled() {
+				t.Errorf("something stopped our execution trace")
+			}
+			trace.Stop()
+		}()
+
+		// The bundle should include the CPU profile it asked for, and explain
+		// why it lacks the execution trace.
+		var buf bytes.Buffer
+		c := autoprof.NewZipCollector(&buf, meta, &autoprof.ArchiveOptions{
+			CPUProfileDuration:     100 * time.Millisecond,
+			ExecutionTraceDuration: 100 * time.Millisecond,
+		})
+		err = c.Run(ctx)
+		if err != nil {
+			t.Fatalf("Run; err = %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("zip.NewReader; err = %v", err)
+		}
+		checkExist(t, zr, profileName)
+		checkNotExist(t, zr, traceName)
+		checkNotExist(t, zr, profileDuringTraceName)
+
+		// The attempt to run a CPU profile during the execution trace should
+		// not leave the CPU profiler running.
+		if profileIsEnabled() {
+			t.Errorf("a CPU profile remained active")
+		}
+
+		// The Collector should report why it did not include the trace.
+		checkSkipped(t, c.Manifest(), autoprof.SkipBusy, traceName)
+		if skipped := c.Manifest().Skipped; len(skipped) > 0 {
+			if have, want := skipped[0].RequestedDuration, 100*time.Millisecond; have != want {
+				t.Errorf("Skipped[0].RequestedDuration; %s != %s", have, want)
+			}
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		if profileIsEnabled() {
+			t.Skip("a CPU profile is already active")
+		}
+		if trace.IsEnabled() {
+			t.Skip("an execution trace is already active")
+		}
+
+		zr, err := collect(ctx, meta, &autoprof.ArchiveOptions{
+			CPUProfileDuration:       100 * time.Millisecond,
+			ExecutionTraceDuration:   10 * time.Second,
+			ExecutionTraceByteTarget: 1,
+		})
+		if err != nil {
+			t.Fatalf("collect; err = %v", err)
+		}
+
+		if last := zr.File[len(zr.File)-1].Name; last != "manifest" {
+			t.Errorf("final file is %q, not manifest", last)
+		}
+		manifest := readManifest(t, zr)
+
+		if have, want := len(manifest.Entries), len(zr.File)-1; have != want {
+			t.Fatalf("manifest has %d entries, expected %d", have, want)
+		}
+		for i, rec := range manifest.Entries {
+			file := zr.File[i]
+			if rec.Name != file.Name {
+				t.Errorf("manifest entry %d is %q, file is %q", i, rec.Name, file.Name)
+			}
+			if have, want := rec.Bytes, int64(file.UncompressedSize64); have != want {
+				t.Errorf("manifest entry %q; %d bytes != %d", rec.Name, have, want)
+			}
+			if rec.End.Before(rec.Start) {
+				t.Errorf("manifest entry %q; ends before it starts", rec.Name)
+			}
+
+			var reason autoprof.StopReason
+			switch rec.Name {
+			case profileName:
+				reason = autoprof.StopDuration
+				if d := rec.End.Sub(rec.Start); d < 100*time.Millisecond {
+					t.Errorf("manifest entry %q; ran for only %s", rec.Name, d)
+				}
+			case traceName, profileDuringTraceName:
+				reason = autoprof.StopByteTarget
+			}
+			if have, want := rec.StopReason, reason; have != want {
+				t.Errorf("manifest entry %q; stop reason %q != %q", rec.Name, have, want)
+			}
+		}
+	})
+
+	t.Run("failing data source", func(t *testing.T) {
+		errBroken := errors.New("broken")
+		opt := &autoprof.ArchiveOptions{
+			CustomDataSources: map[string]*autoprof.DataSource{
+				"a-broken": {WriteTo: func(ctx context.Context, w io.Writer) error {
+					_, err := io.WriteString(w, "partial")
+					if err != nil {
+						return err
+					}
+					return errBroken
+				}},
+				"b-working": {WriteTo: func(ctx context.Context, w io.Writer) error {
+					_, err := io.WriteString(w, "complete")
+					return err
+				}},
+			},
+		}
+
+		// By default, the first failure ends the collection.
+		_, err := collect(ctx, meta, opt)
+		if !errors.Is(err, errBroken) {
+			t.Errorf("collect; err = %v, expected %v", err, errBroken)
+		}
+
+		// When requested, the collector notes the failure and continues.
+		opt.RecordErrors = true
+		zr, err := collect(ctx, meta, opt)
+		if err != nil {
+			t.Fatalf("collect; err = %v", err)
+		}
+		checkExist(t, zr, "custom/a-broken")
+		checkExist(t, zr, "custom/b-working")
+
+		buf, err := fs.ReadFile(zr, "errors")
+		if err != nil {
+			t.Fatalf("ReadFile(\"errors\"); err = %v", err)
+		}
+		var entryErrs []*autoprof.EntryError
+		err = json.Unmarshal(buf, &entryErrs)
+		if err != nil {
+			t.Fatalf("json.Unmarshal(\"errors\"); err = %v", err)
+		}
+		if len(entryErrs) != 1 {
+			t.Fatalf("errors; found %d records, expected 1", len(entryErrs))
+		}
+		if have, want := *entryErrs[0], (autoprof.EntryError{
+			Name:         "custom/a-broken",
+			Error:        "broken",
+			BytesWritten: int64(len("partial")),
+		}); have != want {
+			t.Errorf("errors; %#v != %#v", have, want)
+		}
+	})
+
+	t.Run("failing writer", func(t *testing.T) {
+		// Errors from the underlying io.Writer always end the collection.
+		err := autoprof.NewZipCollector(&failWriter{remaining: 1 << 10}, meta, &autoprof.ArchiveOptions{
+			RecordErrors: true,
+		}).Run(ctx)
+		if !errors.Is(err, errWriteFailed) {
+			t.Errorf("Run; err = %v, expected %v", err, errWriteFailed)
+		}
+	})
+}
+
+func readManifest(t *testing.T, zr *zip.Reader) *autoprof.Manifest {
+	buf, err := fs.ReadFile(zr, "manifest")
+	if err != nil {
+		t.Fatalf("ReadFile(\"manifest\"); err = %v", err)
+	}
+	var manifest autoprof.Manifest
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(\"manifest\"); err = %v", err)
+	}
+	return &manifest
+}
+
+func checkSkipped(t *testing.T, manifest *autoprof.Manifest, reason autoprof.SkipReason, names ...string) {
+	var skipped []string
+	for _, rec := range manifest.Skipped {
+		skipped = append(skipped, rec.Name)
+		if rec.Reason != reason {
+			t.Errorf("skipped %q; reason %q != %q", rec.Name, rec.Reason, reason)
+		}
+		if rec.Error == "" {
+			t.Errorf("skipped %q without an error", rec.Name)
+		}
+	}
+	if have, want := fmt.Sprint(skipped), fmt.Sprint(names); have != want {
+		t.Errorf("skipped profiles; %s != %s", have, want)
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failWriter accepts a limited number of bytes, and then returns an error.
+type failWriter struct {
+	remaining int
+}
+
+func (fw *failWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.remaining {
+		n := fw.remaining
+		fw.remaining = 0
+		return n, errWriteFailed
+	}
+	fw.remaining -= len(p)
+	return len(p), nil
 }
 
 func collect(ctx context.Context, meta *autoprof.ArchiveMeta, opt *autoprof.ArchiveOptions) (*zip.Reader, error) {
@@ -0,0 +1,260 @@
+package autoprof
+
+import (
+	"context"
+	"sync"
+)
+
+// A Profiler identifies one of the process-wide profilers that the Go runtime
+// provides. Profiler values may be combined with bitwise OR.
+type Profiler int
+
+const (
+	// CPUProfiler is the profiler that runtime/pprof.StartCPUProfile
+	// controls.
+	CPUProfiler Profiler = 1 << iota
+	// ExecutionTracer is the profiler that runtime/trace.Start controls.
+	ExecutionTracer
+)
+
+var allProfilers = [...]Profiler{CPUProfiler, ExecutionTracer}
+
+// A Priority orders competing requests to use the process's profilers.
+type Priority int
+
+const (
+	// PriorityBackground is for work that can be delayed or interrupted, such
+	// as scheduled collection of profile bundles. Background requests wait
+	// for any interactive requests, and the Coordinator preempts a background
+	// Lease when an interactive request needs the same profiler.
+	PriorityBackground Priority = iota
+	// PriorityInteractive is for work that someone is waiting on, such as an
+	// HTTP request to Handler. Interactive requests wait for each other, but
+	// not for background requests.
+	PriorityInteractive
+)
+
+// DefaultCoordinator is the Coordinator that Collectors use to access the
+// process's CPU profiler and execution tracer.
+//
+// Application code that uses the runtime/pprof or runtime/trace packages
+// directly can take part in the same scheme, so its work does not conflict
+// with autoprof's:
+//
+//	lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.ExecutionTracer, autoprof.PriorityInteractive)
+//	if err != nil {
+//		return err
+//	}
+//	defer lease.Release()
+//	err = trace.Start(w)
+//	...
+var DefaultCoordinator = &Coordinator{}
+
+// A Coordinator serializes access to the process's CPU profiler and execution
+// tracer. Its zero value is ready to use. Most programs should use
+// DefaultCoordinator.
+type Coordinator struct {
+	mu sync.Mutex
+	// holders records who is using each profiler, indexed as allProfilers.
+	holders [len(allProfilers)]*Lease
+	// waiting counts the interactive requests that are waiting for each
+	// profiler, indexed as allProfilers.
+	waiting [len(allProfilers)]int
+	// queued counts the requests of any priority that are waiting for each
+	// profiler, indexed as allProfilers.
+	queued [len(allProfilers)]int
+	// changed is closed and replaced when the state of the Coordinator
+	// changes in a way that may allow a waiting request to proceed.
+	changed chan struct{}
+}
+
+// A Lease is a claim on some of the process's profilers.
+type Lease struct {
+	c        *Coordinator
+	priority Priority
+
+	preempted   chan struct{}
+	preemptOnce sync.Once
+	contended   chan struct{}
+	contendOnce sync.Once
+	releaseOnce sync.Once
+}
+
+// Preempted returns a channel which is closed when a higher-priority request
+// needs the profilers. The holder should stop using them and call Release
+// promptly.
+func (l *Lease) Preempted() <-chan struct{} {
+	return l.preempted
+}
+
+// Contended returns a channel which is closed when another request, of any
+// priority, is waiting for the profilers. A background holder that would
+// otherwise keep the profilers indefinitely, such as a continuous profiler,
+// should stop using them and call Release, and then Acquire them again. A new
+// background request, including that next call to Acquire, yields to the
+// requests that are already waiting, so one of them goes first. The
+// Coordinator does not otherwise order the waiting requests: when the
+// profilers become available, any of them may claim them.
+func (l *Lease) Contended() <-chan struct{} {
+	return l.contended
+}
+
+// Release returns the profilers to the Coordinator. The holder must stop using
+// them before calling Release. Calls after the first have no effect.
+func (l *Lease) Release() {
+	l.releaseOnce.Do(func() {
+		c := l.c
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i := range c.holders {
+			if c.holders[i] == l {
+				c.holders[i] = nil
+			}
+		}
+		c.broadcastLocked()
+	})
+}
+
+func (l *Lease) preempt() {
+	l.preemptOnce.Do(func() { close(l.preempted) })
+}
+
+func (l *Lease) contend() {
+	l.contendOnce.Do(func() { close(l.contended) })
+}
+
+// Acquire waits until the requested profilers are available and then claims
+// them for the caller's use. The caller must Release the Lease when it has
+// stopped using the profilers.
+//
+// If ctx is done before the profilers become available, Acquire returns
+// ctx.Err().
+func (c *Coordinator) Acquire(ctx context.Context, profilers Profiler, priority Priority) (*Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if priority == PriorityInteractive {
+		c.addWaiting(profilers, 1)
+		defer c.addWaiting(profilers, -1)
+	}
+
+	queued := false
+	defer func() {
+		if queued {
+			c.addQueued(profilers, -1)
+		}
+	}()
+
+	for !c.available(profilers, priority, queued) {
+		if !queued {
+			queued = true
+			c.addQueued(profilers, 1)
+		}
+		if priority == PriorityInteractive {
+			c.preempt(profilers)
+		}
+
+		changed := c.changedLocked()
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		}
+		c.mu.Lock()
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if queued {
+		queued = false
+		c.addQueued(profilers, -1)
+	}
+	lease := &Lease{
+		c:         c,
+		priority:  priority,
+		preempted: make(chan struct{}),
+		contended: make(chan struct{}),
+	}
+	for i, p := range allProfilers {
+		if profilers&p != 0 {
+			c.holders[i] = lease
+			if c.queued[i] > 0 {
+				lease.contend()
+			}
+		}
+	}
+
+	return lease, nil
+}
+
+// available reports whether a request of the provided priority may claim the
+// profilers. Background requests yield to waiting interactive requests, and
+// new background requests also yield to those that are already waiting.
+func (c *Coordinator) available(profilers Profiler, priority Priority, queued bool) bool {
+	for i, p := range allProfilers {
+		if profilers&p == 0 {
+			continue
+		}
+		if c.holders[i] != nil {
+			return false
+		}
+		if priority == PriorityBackground && c.waiting[i] > 0 {
+			return false
+		}
+		if priority == PriorityBackground && !queued && c.queued[i] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// preempt asks the background holders of any of the profilers to stop.
+func (c *Coordinator) preempt(profilers Profiler) {
+	for i, p := range allProfilers {
+		if lease := c.holders[i]; profilers&p != 0 && lease != nil && lease.priority == PriorityBackground {
+			lease.preempt()
+		}
+	}
+}
+
+func (c *Coordinator) addWaiting(profilers Profiler, delta int) {
+	for i, p := range allProfilers {
+		if profilers&p != 0 {
+			c.waiting[i] += delta
+		}
+	}
+	if delta < 0 {
+		// Background requests may have been waiting on this one.
+		c.broadcastLocked()
+	}
+}
+
+// addQueued updates the count of requests waiting for the profilers. New
+// waiters contend for the current holders' leases.
+func (c *Coordinator) addQueued(profilers Profiler, delta int) {
+	for i, p := range allProfilers {
+		if profilers&p != 0 {
+			c.queued[i] += delta
+			if lease := c.holders[i]; delta > 0 && lease != nil {
+				lease.contend()
+			}
+		}
+	}
+	c.broadcastLocked()
+}
+
+func (c *Coordinator) changedLocked() chan struct{} {
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+func (c *Coordinator) broadcastLocked() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
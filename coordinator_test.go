@@ -0,0 +1,219 @@
+package autoprof_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+func TestCoordinator(t *testing.T) {
+	ctx := context.Background()
+
+	acquire := func(t *testing.T, c *autoprof.Coordinator, profilers autoprof.Profiler, priority autoprof.Priority) *autoprof.Lease {
+		lease, err := c.Acquire(ctx, profilers, priority)
+		if err != nil {
+			t.Fatalf("Acquire; err = %v", err)
+		}
+		return lease
+	}
+
+	isPreempted := func(lease *autoprof.Lease) bool {
+		select {
+		case <-lease.Preempted():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t.Run("disjoint", func(t *testing.T) {
+		var c autoprof.Coordinator
+		cpu := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityBackground)
+		tr := acquire(t, &c, autoprof.ExecutionTracer, autoprof.PriorityBackground)
+		cpu.Release()
+		tr.Release()
+		both := acquire(t, &c, autoprof.CPUProfiler|autoprof.ExecutionTracer, autoprof.PriorityBackground)
+		both.Release()
+	})
+
+	t.Run("bounded wait", func(t *testing.T) {
+		var c autoprof.Coordinator
+		lease := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityInteractive)
+		defer lease.Release()
+
+		for _, priority := range []autoprof.Priority{autoprof.PriorityBackground, autoprof.PriorityInteractive} {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			_, err := c.Acquire(ctx, autoprof.CPUProfiler, priority)
+			cancel()
+			if err != context.DeadlineExceeded {
+				t.Errorf("Acquire(priority=%d); err = %v, expected %v", priority, err, context.DeadlineExceeded)
+			}
+		}
+		if isPreempted(lease) {
+			t.Errorf("interactive lease was preempted")
+		}
+	})
+
+	t.Run("preempt background", func(t *testing.T) {
+		var c autoprof.Coordinator
+		background := acquire(t, &c, autoprof.CPUProfiler|autoprof.ExecutionTracer, autoprof.PriorityBackground)
+		go func() {
+			<-background.Preempted()
+			background.Release()
+		}()
+
+		interactive := acquire(t, &c, autoprof.ExecutionTracer, autoprof.PriorityInteractive)
+		defer interactive.Release()
+		if !isPreempted(background) {
+			t.Errorf("background lease was not preempted")
+		}
+	})
+
+	t.Run("background yields", func(t *testing.T) {
+		var c autoprof.Coordinator
+		first := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityInteractive)
+
+		order := make(chan autoprof.Priority, 2)
+		waiting := make(chan struct{})
+		go func() {
+			lease := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityInteractive)
+			order <- autoprof.PriorityInteractive
+			lease.Release()
+		}()
+		go func() {
+			<-waiting
+			lease := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityBackground)
+			order <- autoprof.PriorityBackground
+			lease.Release()
+		}()
+
+		// Give the interactive request time to start waiting.
+		time.Sleep(10 * time.Millisecond)
+		close(waiting)
+		time.Sleep(10 * time.Millisecond)
+		first.Release()
+
+		if have, want := <-order, autoprof.PriorityInteractive; have != want {
+			t.Errorf("first to acquire; priority %d != %d", have, want)
+		}
+		<-order
+	})
+
+	t.Run("contended", func(t *testing.T) {
+		var c autoprof.Coordinator
+		holder := acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityBackground)
+
+		acquired := make(chan *autoprof.Lease)
+		go func() { acquired <- acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityBackground) }()
+
+		// The holder learns that another background request is waiting. When
+		// it gives up the profiler and asks again, the waiting request goes
+		// first.
+		<-holder.Contended()
+		if isPreempted(holder) {
+			t.Errorf("background lease was preempted by a background request")
+		}
+		holder.Release()
+		again := make(chan *autoprof.Lease)
+		go func() { again <- acquire(t, &c, autoprof.CPUProfiler, autoprof.PriorityBackground) }()
+
+		waiter := <-acquired
+		select {
+		case <-waiter.Contended():
+		case <-time.After(10 * time.Second):
+			t.Errorf("new holder did not see the holder that's waiting again")
+		}
+		waiter.Release()
+		(<-again).Release()
+	})
+}
+
+func TestCollectorPreempted(t *testing.T) {
+	if profileIsEnabled() {
+		t.Skip("a CPU profile is already active")
+	}
+
+	ctx := context.Background()
+	meta := autoprof.CurrentArchiveMeta()
+
+	var buf bytes.Buffer
+	c := autoprof.NewZipCollector(&buf, meta, &autoprof.ArchiveOptions{
+		CPUProfileDuration: 10 * time.Second,
+		Priority:           autoprof.PriorityBackground,
+	})
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Run(ctx) }()
+
+	// Wait for the collector to claim the CPU profiler, and then interrupt it.
+	for {
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.CPUProfiler, autoprof.PriorityBackground)
+		cancel()
+		if err != nil {
+			break
+		}
+		lease.Release()
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.CPUProfiler, autoprof.PriorityInteractive)
+	if err != nil {
+		t.Fatalf("Acquire; err = %v", err)
+	}
+	lease.Release()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Acquire took %s", d)
+	}
+
+	err = <-errCh
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+
+	var found bool
+	for _, rec := range c.Manifest().Entries {
+		if rec.Name == "pprof/profile" {
+			found = true
+			if have, want := rec.StopReason, autoprof.StopPreempted; have != want {
+				t.Errorf("stop reason; %q != %q", have, want)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("bundle does not include a CPU profile")
+	}
+}
+
+func TestCollectorWaitExpired(t *testing.T) {
+	ctx := context.Background()
+	meta := autoprof.CurrentArchiveMeta()
+
+	lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.ExecutionTracer, autoprof.PriorityInteractive)
+	if err != nil {
+		t.Fatalf("Acquire; err = %v", err)
+	}
+	defer lease.Release()
+
+	// The collector gives up on the execution tracer, which someone else
+	// holds, and notes why the bundle doesn't include a trace.
+	var buf bytes.Buffer
+	c := autoprof.NewZipCollector(&buf, meta, &autoprof.ArchiveOptions{
+		IncludeProfiles:        []string{"heap"},
+		ExecutionTraceDuration: 100 * time.Millisecond,
+		ProfilerWait:           10 * time.Millisecond,
+	})
+	err = c.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	skipped := c.Manifest().Skipped
+	if len(skipped) != 1 {
+		t.Fatalf("skipped %d profiles, expected 1", len(skipped))
+	}
+	if have, want := skipped[0].Reason, autoprof.SkipWaitExpired; have != want {
+		t.Errorf("skip reason; %q != %q", have, want)
+	}
+}
@@ -0,0 +1,459 @@
+package autoprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deltaProfileNames lists the cumulative runtime/pprof profiles, in the order
+// their deltas appear in a profile bundle.
+var deltaProfileNames = []string{"heap", "allocs", "block", "mutex"}
+
+// A ProfileSnapshot holds copies of the cumulative runtime/pprof profiles
+// ("heap", "allocs", "block", and "mutex") from a single point in time, for
+// use as the base of delta profiles.
+type ProfileSnapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+
+	names    []string
+	profiles map[string][]byte
+}
+
+// takeProfileSnapshot copies the cumulative profiles that the options allow
+// the profile bundle to include. It passes each profile that it could not copy
+// to fail, and leaves that profile out of the snapshot.
+func takeProfileSnapshot(opt *ArchiveOptions, fail func(name string, err error)) *ProfileSnapshot {
+	snap := &ProfileSnapshot{
+		Time:     time.Now(),
+		profiles: make(map[string][]byte),
+	}
+	for _, name := range deltaProfileNames {
+		profile := pprof.Lookup(name)
+		if profile == nil || !opt.includeProfile(name) {
+			continue
+		}
+		var buf bytes.Buffer
+		err := profile.WriteTo(&buf, 0)
+		if err != nil {
+			fail(name, fmt.Errorf("snapshot of %q profile: %w", name, err))
+			continue
+		}
+		snap.names = append(snap.names, name)
+		snap.profiles[name] = buf.Bytes()
+	}
+	return snap
+}
+
+// snapshotProfiles copies the cumulative profiles for the profile bundle,
+// noting each failure under the name of the delta profile it affects.
+func (c *Collector) snapshotProfiles() *ProfileSnapshot {
+	return takeProfileSnapshot(c.opt, func(name string, err error) {
+		c.fail("pprof-delta/"+url.PathEscape(name), err)
+	})
+}
+
+// addDeltaProfiles writes the change in each profile from base to end into the
+// profile bundle.
+func (c *Collector) addDeltaProfiles(ctx context.Context, base, end *ProfileSnapshot) {
+	for _, name := range end.names {
+		prev, ok := base.profiles[name]
+		if !ok {
+			continue
+		}
+		cur := end.profiles[name]
+		c.add(ctx, "pprof-delta/"+url.PathEscape(name), &DataSource{WriteTo: func(ctx context.Context, w io.Writer) error {
+			return writeDeltaProfile(w, prev, cur)
+		}})
+	}
+}
+
+// writeDeltaProfile writes the gzip-compressed protobuf-encoded profile which
+// results from subtracting the sample values in the base profile from those in
+// the end profile. Both inputs are gzip-compressed protobuf-encoded profiles as
+// runtime/pprof writes them.
+//
+// Samples in the two profiles match when they have the same call stack
+// (comparing the address and function names of each frame) and the same
+// labels. The output keeps all of the end profile's other data, such as its
+// locations and string table, and describes the time between the two
+// profiles as its duration.
+func writeDeltaProfile(w io.Writer, base, end []byte) error {
+	bp, err := parseProfileProto(base)
+	if err != nil {
+		return fmt.Errorf("base profile: %w", err)
+	}
+	ep, err := parseProfileProto(end)
+	if err != nil {
+		return fmt.Errorf("end profile: %w", err)
+	}
+
+	prev := make(map[string][]int64)
+	for _, s := range bp.samples {
+		key := bp.sampleKey(s)
+		prev[key] = addValues(prev[key], s.values)
+	}
+
+	var out []byte
+	for _, f := range ep.fields {
+		switch f.num {
+		case profileSample, profileDurationNanos:
+			// replaced below
+		default:
+			out = append(out, f.raw...)
+		}
+	}
+	for _, s := range ep.samples {
+		values := addValues(nil, s.values)
+		nonzero := false
+		for i, v := range prev[ep.sampleKey(s)] {
+			if i < len(values) {
+				values[i] -= v
+			}
+		}
+		for _, v := range values {
+			nonzero = nonzero || v != 0
+		}
+		if !nonzero {
+			continue
+		}
+
+		var msg []byte
+		msg = append(msg, s.other...)
+		var packed []byte
+		for _, v := range values {
+			packed = binary.AppendUvarint(packed, uint64(v))
+		}
+		msg = appendBytesField(msg, sampleValue, packed)
+		out = appendBytesField(out, profileSample, msg)
+	}
+	if ep.timeNanos != 0 && bp.timeNanos != 0 {
+		out = binary.AppendUvarint(out, uint64(profileDurationNanos)<<3|wireVarint)
+		out = binary.AppendUvarint(out, uint64(ep.timeNanos-bp.timeNanos))
+	}
+
+	zw := gzip.NewWriter(w)
+	_, err = zw.Write(out)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addValues(sum, values []int64) []int64 {
+	for len(sum) < len(values) {
+		sum = append(sum, 0)
+	}
+	for i, v := range values {
+		sum[i] += v
+	}
+	return sum
+}
+
+// Field numbers from github.com/google/pprof/proto/profile.proto
+const (
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+	labelNum = 3
+
+	locationID      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+
+	functionID   = 1
+	functionName = 2
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// profileProto is a partially-decoded protobuf-encoded profile, holding the
+// parts necessary to match samples between profiles.
+type profileProto struct {
+	fields    []protoField
+	samples   []*protoSample
+	strings   []string
+	timeNanos int64
+
+	// locations maps location IDs to a description of the call stack frame.
+	locations map[uint64]string
+	// functions maps function IDs to their name's index in the string table.
+	functions map[uint64]int64
+
+	// rawLocations holds the encoded locations until the function names are
+	// known.
+	rawLocations [][]byte
+}
+
+type protoSample struct {
+	locations []uint64
+	values    []int64
+	labels    [][]byte
+	// other holds the encoded fields of the sample, other than its values.
+	other []byte
+}
+
+type protoField struct {
+	num  int
+	typ  int
+	raw  []byte // the full encoding of the field, including its tag
+	data []byte // for wireBytes, the field's contents
+	v    uint64 // for wireVarint, wireFixed64, and wireFixed32, the value
+}
+
+func parseProfileProto(gz []byte) (*profileProto, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &profileProto{
+		locations: make(map[uint64]string),
+		functions: make(map[uint64]int64),
+	}
+	p.fields, err = parseProtoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range p.fields {
+		switch {
+		case f.num == profileSample && f.typ == wireBytes:
+			s, err := parseProtoSample(f.data)
+			if err != nil {
+				return nil, err
+			}
+			p.samples = append(p.samples, s)
+		case f.num == profileLocation && f.typ == wireBytes:
+			p.rawLocations = append(p.rawLocations, f.data)
+		case f.num == profileFunction && f.typ == wireBytes:
+			fields, err := parseProtoFields(f.data)
+			if err != nil {
+				return nil, err
+			}
+			var id uint64
+			var name int64
+			for _, ff := range fields {
+				switch ff.num {
+				case functionID:
+					id = ff.v
+				case functionName:
+					name = int64(ff.v)
+				}
+			}
+			p.functions[id] = name
+		case f.num == profileStringTable && f.typ == wireBytes:
+			p.strings = append(p.strings, string(f.data))
+		case f.num == profileTimeNanos && f.typ == wireVarint:
+			p.timeNanos = int64(f.v)
+		}
+	}
+
+	for _, data := range p.rawLocations {
+		err := p.parseLocation(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.rawLocations = nil
+
+	return p, nil
+}
+
+func (p *profileProto) parseLocation(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+	var id, addr uint64
+	var funcs []string
+	for _, f := range fields {
+		switch f.num {
+		case locationID:
+			id = f.v
+		case locationAddress:
+			addr = f.v
+		case locationLine:
+			lines, err := parseProtoFields(f.data)
+			if err != nil {
+				return err
+			}
+			for _, lf := range lines {
+				if lf.num == lineFunctionID {
+					funcs = append(funcs, p.str(p.functions[lf.v]))
+				}
+			}
+		}
+	}
+	p.locations[id] = strconv.FormatUint(addr, 16) + "/" + strings.Join(funcs, "/")
+	return nil
+}
+
+func (p *profileProto) str(i int64) string {
+	if i < 0 || i >= int64(len(p.strings)) {
+		return ""
+	}
+	return p.strings[i]
+}
+
+// sampleKey describes the sample's call stack and labels, for matching it with
+// samples in other profiles.
+func (p *profileProto) sampleKey(s *protoSample) string {
+	var b strings.Builder
+	for _, id := range s.locations {
+		b.WriteString(p.locations[id])
+		b.WriteByte(';')
+	}
+	for _, label := range s.labels {
+		fields, _ := parseProtoFields(label)
+		var key, str string
+		var num int64
+		for _, f := range fields {
+			switch f.num {
+			case labelKey:
+				key = p.str(int64(f.v))
+			case labelStr:
+				str = p.str(int64(f.v))
+			case labelNum:
+				num = int64(f.v)
+			}
+		}
+		fmt.Fprintf(&b, "|%q=%q/%d", key, str, num)
+	}
+	return b.String()
+}
+
+func parseProtoSample(data []byte) (*protoSample, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &protoSample{}
+	for _, f := range fields {
+		switch f.num {
+		case sampleLocationID:
+			s.locations, err = appendRepeated(s.locations, f)
+			if err != nil {
+				return nil, err
+			}
+		case sampleValue:
+			var values []uint64
+			values, err = appendRepeated(nil, f)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				s.values = append(s.values, int64(v))
+			}
+			continue
+		case sampleLabel:
+			s.labels = append(s.labels, f.data)
+		}
+		s.other = append(s.other, f.raw...)
+	}
+	return s, nil
+}
+
+// appendRepeated appends the values of a repeated integer field, which may be
+// in packed or unpacked form.
+func appendRepeated(dst []uint64, f protoField) ([]uint64, error) {
+	if f.typ != wireBytes {
+		return append(dst, f.v), nil
+	}
+	data := f.data
+	for len(data) > 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errInvalidProto
+		}
+		dst = append(dst, v)
+		data = data[n:]
+	}
+	return dst, nil
+}
+
+var errInvalidProto = errors.New("invalid protobuf encoding")
+
+func parseProtoFields(buf []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(buf) > 0 {
+		start := buf
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errInvalidProto
+		}
+		buf = buf[n:]
+
+		f := protoField{num: int(tag >> 3), typ: int(tag & 7)}
+		switch f.typ {
+		case wireVarint:
+			f.v, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errInvalidProto
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return nil, errInvalidProto
+			}
+			f.v = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return nil, errInvalidProto
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < l {
+				return nil, errInvalidProto
+			}
+			f.data = buf[n : n+int(l)]
+			buf = buf[n+int(l):]
+		default:
+			return nil, errInvalidProto
+		}
+		f.raw = start[:len(start)-len(buf)]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func appendBytesField(dst []byte, num int, data []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(num)<<3|wireBytes)
+	dst = binary.AppendUvarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
@@ -0,0 +1,163 @@
+package autoprof
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeProfile(t *testing.T, name string) []byte {
+	var buf bytes.Buffer
+	err := pprof.Lookup(name).WriteTo(&buf, 0)
+	if err != nil {
+		t.Fatalf("WriteTo(%q); err = %v", name, err)
+	}
+	return buf.Bytes()
+}
+
+func sumValues(t *testing.T, buf []byte) []int64 {
+	p, err := parseProfileProto(buf)
+	if err != nil {
+		t.Fatalf("parseProfileProto; err = %v", err)
+	}
+	var sum []int64
+	for _, s := range p.samples {
+		sum = addValues(sum, s.values)
+	}
+	return sum
+}
+
+func TestDeltaProfile(t *testing.T) {
+	t.Run("unchanged", func(t *testing.T) {
+		prof := writeProfile(t, "goroutine")
+		var buf bytes.Buffer
+		err := writeDeltaProfile(&buf, prof, prof)
+		if err != nil {
+			t.Fatalf("writeDeltaProfile; err = %v", err)
+		}
+		p, err := parseProfileProto(buf.Bytes())
+		if err != nil {
+			t.Fatalf("parseProfileProto; err = %v", err)
+		}
+		if len(p.samples) != 0 {
+			t.Errorf("delta of identical profiles has %d samples", len(p.samples))
+		}
+		if len(p.strings) == 0 || len(p.locations) == 0 {
+			t.Errorf("delta did not keep string table and locations")
+		}
+	})
+
+	t.Run("mutex", func(t *testing.T) {
+		defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(1))
+
+		contend := func() {
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						mu.Lock()
+						time.Sleep(10 * time.Microsecond)
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+		}
+
+		contend()
+		base := writeProfile(t, "mutex")
+		contend()
+		end := writeProfile(t, "mutex")
+
+		var buf bytes.Buffer
+		err := writeDeltaProfile(&buf, base, end)
+		if err != nil {
+			t.Fatalf("writeDeltaProfile; err = %v", err)
+		}
+
+		baseSum, endSum, deltaSum := sumValues(t, base), sumValues(t, end), sumValues(t, buf.Bytes())
+		if len(deltaSum) == 0 || deltaSum[0] <= 0 {
+			t.Fatalf("delta profile shows no contention: %v", deltaSum)
+		}
+		for i := range deltaSum {
+			if have, want := deltaSum[i], endSum[i]-baseSum[i]; have != want {
+				t.Errorf("value %d; delta %d != %d - %d", i, have, endSum[i], baseSum[i])
+			}
+		}
+	})
+}
+
+func TestCollectorDeltaProfiles(t *testing.T) {
+	ctx := context.Background()
+	opt := &ArchiveOptions{
+		ExecutionTraceDuration: 10 * time.Millisecond,
+		DeltaProfiles:          true,
+		ExcludeProfiles:        []string{"allocs"},
+	}
+
+	c := NewZipCollector(new(bytes.Buffer), CurrentArchiveMeta(), opt)
+	err := c.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	var names []string
+	for _, rec := range c.Manifest().Entries {
+		if len(rec.Name) > len("pprof-delta/") && rec.Name[:len("pprof-delta/")] == "pprof-delta/" {
+			names = append(names, rec.Name)
+		}
+	}
+	if have, want := len(names), 3; have != want {
+		t.Errorf("found %d delta profiles %q, expected %d", have, names, want)
+	}
+
+	// A later collection can find the change since the previous one, even
+	// without any time-based profiles of its own.
+	snap := c.DeltaSnapshot()
+	if snap == nil {
+		t.Fatalf("DeltaSnapshot; nil")
+	}
+	c = NewZipCollector(new(bytes.Buffer), CurrentArchiveMeta(), &ArchiveOptions{
+		IncludeProfiles: []string{"heap"},
+		DeltaProfiles:   true,
+		DeltaBase:       snap,
+	})
+	err = c.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	var found bool
+	for _, rec := range c.Manifest().Entries {
+		found = found || rec.Name == "pprof-delta/heap"
+	}
+	if !found {
+		t.Errorf("did not find delta heap profile relative to DeltaBase")
+	}
+}
+
+func TestCollectorDeltaProfileError(t *testing.T) {
+	// A delta profile that can't be written ends the collection when the
+	// caller hasn't asked to record errors, even when there's no
+	// runtime/metrics snapshot to write after it.
+	ctx := context.Background()
+	base := &ProfileSnapshot{
+		Time:     time.Now(),
+		names:    []string{"heap"},
+		profiles: map[string][]byte{"heap": []byte("not a profile")},
+	}
+	c := NewZipCollector(new(bytes.Buffer), CurrentArchiveMeta(), &ArchiveOptions{
+		ExcludeProfiles: []string{"runtime/metrics"},
+		DeltaProfiles:   true,
+		DeltaBase:       base,
+	})
+	err := c.Run(ctx)
+	if err == nil {
+		t.Fatalf("Run; err = nil, expected failure to write delta heap profile")
+	}
+}
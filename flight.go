@@ -0,0 +1,345 @@
+package autoprof
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A FlightRecorder keeps the execution tracer running, holding the most recent
+// portion of the trace in memory, so that a profile bundle can include the
+// moments before something interesting happened. Set the FlightRecorder field
+// of ArchiveOptions to include a snapshot in a bundle.
+//
+// When the Go runtime provides a flight recorder (Go 1.25 and newer), this type
+// uses it. Otherwise, it runs the execution tracer in generations: it restarts
+// the tracer every MinAge, keeping the previous generation's trace as well as
+// the current one. That fallback holds the execution tracer through
+// DefaultCoordinator with background priority. When any other request for the
+// execution tracer is waiting, including a background collection, the fallback
+// stops and lets that request go first.
+type FlightRecorder struct {
+	// MinAge is how much recent history to keep. If zero, it defaults to ten
+	// seconds.
+	MinAge time.Duration
+	// MaxBytes is a soft limit on the memory to use for the recent history.
+	// If zero, the runtime chooses the limit, or the fallback uses 32 MiB.
+	MaxBytes int64
+
+	mu   sync.Mutex
+	impl flightImpl
+
+	// forceFallback requests the generation-rotating implementation even when
+	// the runtime provides a flight recorder, for tests.
+	forceFallback bool
+}
+
+const (
+	defaultFlightMinAge   = 10 * time.Second
+	defaultFlightMaxBytes = 32 << 20
+)
+
+var (
+	errFlightStarted    = errors.New("flight recorder is already running")
+	errFlightNotStarted = errors.New("flight recorder is not running")
+	errFlightNoData     = errors.New("flight recorder has no data yet")
+)
+
+// flightImpl is an implementation of the flight recorder.
+type flightImpl interface {
+	start() error
+	stop()
+	snapshot() (*flightSnapshot, error)
+}
+
+// A flightSnapshot holds the execution trace from a flight recorder.
+type flightSnapshot struct {
+	// trace is the execution trace, and start and end are the approximate
+	// times it covers.
+	trace []byte
+	start time.Time
+	end   time.Time
+	// previous is the fallback's previous generation, a separate execution
+	// trace which ends about when trace begins.
+	previous      []byte
+	previousStart time.Time
+}
+
+// Start begins recording.
+func (fr *FlightRecorder) Start() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.impl != nil {
+		return errFlightStarted
+	}
+
+	minAge := fr.MinAge
+	if minAge <= 0 {
+		minAge = defaultFlightMinAge
+	}
+	var impl flightImpl
+	if !fr.forceFallback {
+		impl = newRuntimeFlightRecorder(minAge, fr.MaxBytes)
+	}
+	if impl == nil {
+		maxBytes := fr.MaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultFlightMaxBytes
+		}
+		impl = &rotatingFlightRecorder{minAge: minAge, maxBytes: maxBytes}
+	}
+	err := impl.start()
+	if err != nil {
+		return err
+	}
+	fr.impl = impl
+	return nil
+}
+
+// Stop ends recording, and discards the recent history.
+func (fr *FlightRecorder) Stop() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.impl != nil {
+		fr.impl.stop()
+		fr.impl = nil
+	}
+}
+
+// Enabled reports whether the flight recorder is running.
+func (fr *FlightRecorder) Enabled() bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.impl != nil
+}
+
+// WriteTo writes out the recent execution trace.
+func (fr *FlightRecorder) WriteTo(w io.Writer) (int64, error) {
+	snap, err := fr.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(snap.trace)
+	return int64(n), err
+}
+
+func (fr *FlightRecorder) snapshot() (*flightSnapshot, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.impl == nil {
+		return nil, errFlightNotStarted
+	}
+	return fr.impl.snapshot()
+}
+
+// addFlightRecording writes the flight recorder's snapshot into the profile
+// bundle.
+func (c *Collector) addFlightRecording(snap *flightSnapshot, err error) {
+	const (
+		traceName         = "pprof/trace"
+		previousTraceName = "pprof/trace-previous"
+	)
+	if err != nil {
+		c.skip(traceName, 0, SkipNotRecording, err)
+		return
+	}
+	write := func(name string, buf []byte, start, end time.Time) {
+		if c.addErr != nil {
+			return
+		}
+		w, err := c.createEntry(name)
+		if err != nil {
+			c.addErr = err
+			return
+		}
+		_, err = w.Write(buf)
+		if err != nil {
+			c.addErr = err
+			return
+		}
+		w.rec.Start = start
+		w.rec.End = end
+	}
+	write(traceName, snap.trace, snap.start, snap.end)
+	if snap.previous != nil {
+		write(previousTraceName, snap.previous, snap.previousStart, snap.start)
+	}
+}
+
+// A rotatingFlightRecorder approximates a flight recorder by restarting the
+// execution tracer periodically, and keeping the trace from the previous
+// generation along with the current one.
+type rotatingFlightRecorder struct {
+	minAge   time.Duration
+	maxBytes int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	cur       *countingBuffer // nil when the tracer is not running
+	curStart  time.Time
+	prev      []byte
+	prevStart time.Time
+	prevEnd   time.Time
+}
+
+// A countingBuffer is a bytes.Buffer which allows reading its length while
+// another goroutine writes to it.
+type countingBuffer struct {
+	buf bytes.Buffer
+	n   atomic.Int64
+}
+
+func (b *countingBuffer) Write(p []byte) (int, error) {
+	n, err := b.buf.Write(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (r *rotatingFlightRecorder) start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx)
+	return nil
+}
+
+func (r *rotatingFlightRecorder) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// run holds the execution tracer whenever DefaultCoordinator allows, rotating
+// generations until the context ends.
+func (r *rotatingFlightRecorder) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		lease, err := DefaultCoordinator.Acquire(ctx, ExecutionTracer, PriorityBackground)
+		if err != nil {
+			return
+		}
+		r.hold(ctx, lease)
+		lease.Release()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// hold runs the execution tracer until the context ends, the lease is
+// preempted, or another request is waiting for the execution tracer.
+func (r *rotatingFlightRecorder) hold(ctx context.Context, lease *Lease) {
+	r.mu.Lock()
+	err := r.startGeneration()
+	r.mu.Unlock()
+	if err != nil {
+		// Something outside of DefaultCoordinator is using the execution
+		// tracer. Try again later.
+		t := time.NewTimer(r.minAge)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+		case <-lease.Preempted():
+		case <-lease.Contended():
+		case <-t.C:
+		}
+		return
+	}
+
+	tick := time.NewTicker(r.minAge / 8)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.stopGeneration()
+			r.prev = nil
+			r.mu.Unlock()
+			return
+		case <-lease.Preempted():
+			r.mu.Lock()
+			r.stopGeneration()
+			r.mu.Unlock()
+			return
+		case <-lease.Contended():
+			r.mu.Lock()
+			r.stopGeneration()
+			r.mu.Unlock()
+			return
+		case <-tick.C:
+			r.mu.Lock()
+			switch {
+			case r.cur == nil:
+				// A snapshot was unable to restart the tracer.
+				err = r.startGeneration()
+			case time.Since(r.curStart) >= r.minAge || r.cur.n.Load() >= r.maxBytes/2:
+				r.stopGeneration()
+				err = r.startGeneration()
+			}
+			r.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// startGeneration starts the execution tracer. The caller must hold r.mu.
+func (r *rotatingFlightRecorder) startGeneration() error {
+	buf := &countingBuffer{}
+	err := trace.Start(buf)
+	if err != nil {
+		return err
+	}
+	r.cur = buf
+	r.curStart = time.Now()
+	return nil
+}
+
+// stopGeneration stops the execution tracer, keeping its trace as the
+// previous generation. The caller must hold r.mu.
+func (r *rotatingFlightRecorder) stopGeneration() {
+	if r.cur == nil {
+		return
+	}
+	trace.Stop()
+	r.prev = r.cur.buf.Bytes()
+	r.prevStart = r.curStart
+	r.prevEnd = time.Now()
+	r.cur = nil
+}
+
+func (r *rotatingFlightRecorder) snapshot() (*flightSnapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cur == nil {
+		// The tracer isn't running, perhaps because of an interactive
+		// request. Share the most recent complete generation.
+		if r.prev == nil {
+			return nil, errFlightNoData
+		}
+		return &flightSnapshot{trace: r.prev, start: r.prevStart, end: r.prevEnd}, nil
+	}
+
+	previous, previousStart := r.prev, r.prevStart
+	r.stopGeneration()
+	snap := &flightSnapshot{
+		trace:         r.prev,
+		start:         r.prevStart,
+		end:           r.prevEnd,
+		previous:      previous,
+		previousStart: previousStart,
+	}
+	// If this fails, the next tick of the run loop will notice that the
+	// tracer is not running.
+	r.startGeneration()
+	return snap, nil
+}
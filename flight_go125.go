@@ -0,0 +1,53 @@
+//go:build go1.25
+
+package autoprof
+
+import (
+	"bytes"
+	"runtime/trace"
+	"time"
+)
+
+// runtimeFlightRecorder uses the flight recorder that the Go runtime provides.
+type runtimeFlightRecorder struct {
+	fr      *trace.FlightRecorder
+	minAge  time.Duration
+	started time.Time
+}
+
+func newRuntimeFlightRecorder(minAge time.Duration, maxBytes int64) flightImpl {
+	cfg := trace.FlightRecorderConfig{MinAge: minAge}
+	if maxBytes > 0 {
+		cfg.MaxBytes = uint64(maxBytes)
+	}
+	return &runtimeFlightRecorder{fr: trace.NewFlightRecorder(cfg), minAge: minAge}
+}
+
+func (r *runtimeFlightRecorder) start() error {
+	err := r.fr.Start()
+	if err != nil {
+		return err
+	}
+	r.started = time.Now()
+	return nil
+}
+
+func (r *runtimeFlightRecorder) stop() {
+	r.fr.Stop()
+}
+
+func (r *runtimeFlightRecorder) snapshot() (*flightSnapshot, error) {
+	var buf bytes.Buffer
+	_, err := r.fr.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	// The window holds at least MinAge of history, when the recorder has
+	// been running that long.
+	start := end.Add(-r.minAge)
+	if start.Before(r.started) {
+		start = r.started
+	}
+	return &flightSnapshot{trace: buf.Bytes(), start: start, end: end}, nil
+}
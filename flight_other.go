@@ -0,0 +1,11 @@
+//go:build !go1.25
+
+package autoprof
+
+import "time"
+
+// newRuntimeFlightRecorder returns nil, since the Go runtime does not provide
+// a flight recorder before Go 1.25.
+func newRuntimeFlightRecorder(minAge time.Duration, maxBytes int64) flightImpl {
+	return nil
+}
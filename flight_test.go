@@ -0,0 +1,219 @@
+package autoprof
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFlightRecorder(t *testing.T) {
+	testcase := func(fr *FlightRecorder) func(t *testing.T) {
+		return func(t *testing.T) {
+			_, err := fr.WriteTo(io.Discard)
+			if !errors.Is(err, errFlightNotStarted) {
+				t.Errorf("WriteTo before Start; err = %v, expected %v", err, errFlightNotStarted)
+			}
+
+			err = fr.Start()
+			if err != nil {
+				t.Fatalf("Start; err = %v", err)
+			}
+			defer fr.Stop()
+			if err := fr.Start(); !errors.Is(err, errFlightStarted) {
+				t.Errorf("second Start; err = %v, expected %v", err, errFlightStarted)
+			}
+			if !fr.Enabled() {
+				t.Errorf("Enabled; false after Start")
+			}
+			// Only the fallback splits its history into separate traces.
+			_, wantPrevious := fr.impl.(*rotatingFlightRecorder)
+
+			// Give the recorder some activity to record, across more than one
+			// of the fallback's generations.
+			deadline := time.Now().Add(3 * fr.MinAge)
+			for time.Now().Before(deadline) {
+				runtime.Gosched()
+				time.Sleep(time.Millisecond)
+			}
+
+			var buf bytes.Buffer
+			err = NewZipCollector(&buf, CurrentArchiveMeta(), &ArchiveOptions{
+				IncludeProfiles:        []string{"heap"},
+				ExecutionTraceDuration: time.Hour,
+				FlightRecorder:         fr,
+			}).Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run; err = %v", err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("zip.NewReader; err = %v", err)
+			}
+			trace, err := fs.ReadFile(zr, "pprof/trace")
+			if err != nil {
+				t.Fatalf("ReadFile(\"pprof/trace\"); err = %v", err)
+			}
+			if !bytes.HasPrefix(trace, []byte("go 1.")) {
+				t.Errorf("pprof/trace; does not have an execution trace header")
+			}
+			_, err = fs.Stat(zr, "pprof/trace-previous")
+			if have, want := err == nil, wantPrevious; have != want {
+				t.Errorf("pprof/trace-previous; present = %t, expected %t", have, want)
+			}
+
+			manifestBuf, err := fs.ReadFile(zr, "manifest")
+			if err != nil {
+				t.Fatalf("ReadFile(\"manifest\"); err = %v", err)
+			}
+			var manifest Manifest
+			err = json.Unmarshal(manifestBuf, &manifest)
+			if err != nil {
+				t.Fatalf("json.Unmarshal(\"manifest\"); err = %v", err)
+			}
+			if len(manifest.Skipped) != 0 {
+				t.Errorf("manifest; skipped %d profiles", len(manifest.Skipped))
+			}
+			for _, rec := range manifest.Entries {
+				if rec.Name != "pprof/trace" {
+					continue
+				}
+				if have, want := rec.Bytes, int64(len(trace)); have != want {
+					t.Errorf("manifest entry %q; %d bytes != %d", rec.Name, have, want)
+				}
+				if !rec.Start.Before(rec.End) {
+					t.Errorf("manifest entry %q; does not end after it starts", rec.Name)
+				}
+				if rec.RequestedDuration != 0 {
+					t.Errorf("manifest entry %q; requested duration %s", rec.Name, rec.RequestedDuration)
+				}
+			}
+
+			fr.Stop()
+			if fr.Enabled() {
+				t.Errorf("Enabled; true after Stop")
+			}
+		}
+	}
+
+	t.Run("runtime", testcase(&FlightRecorder{MinAge: 100 * time.Millisecond}))
+	t.Run("fallback", testcase(&FlightRecorder{MinAge: 100 * time.Millisecond, forceFallback: true}))
+}
+
+func TestHandlerFlightRecorder(t *testing.T) {
+	fr := &FlightRecorder{MinAge: 100 * time.Millisecond, forceFallback: true}
+	err := fr.Start()
+	if err != nil {
+		t.Fatalf("Start; err = %v", err)
+	}
+	defer fr.Stop()
+	time.Sleep(10 * time.Millisecond)
+
+	srv := httptest.NewServer(&Handler{FlightRecorder: fr})
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		query string
+		want  bool
+	}{
+		{"?include=heap", false},
+		{"?include=heap&flight=true", true},
+	} {
+		resp, err := http.Get(srv.URL + tt.query)
+		if err != nil {
+			t.Fatalf("http.Get; err = %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll(resp.Body); err = %v", err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("zip.NewReader; err = %v", err)
+		}
+		_, err = fs.Stat(zr, "pprof/trace")
+		if have, want := err == nil, tt.want; have != want {
+			t.Errorf("query %q; pprof/trace present = %t, expected %t", tt.query, have, want)
+		}
+	}
+}
+
+func TestFlightRecorderYields(t *testing.T) {
+	// The fallback recorder holds the execution tracer with background
+	// priority for as long as it runs. It needs to step aside for the
+	// background requests that periodic collection makes, rather than making
+	// each of them wait out its ProfilerWait.
+	fr := &FlightRecorder{MinAge: time.Hour, forceFallback: true}
+	err := fr.Start()
+	if err != nil {
+		t.Fatalf("Start; err = %v", err)
+	}
+	defer fr.Stop()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		err = NewZipCollector(&buf, CurrentArchiveMeta(), &ArchiveOptions{
+			IncludeProfiles:        []string{"heap"},
+			ExecutionTraceDuration: 50 * time.Millisecond,
+			Priority:               PriorityBackground,
+			ProfilerWait:           5 * time.Second,
+		}).Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run; err = %v", err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("zip.NewReader; err = %v", err)
+		}
+		manifestBuf, err := fs.ReadFile(zr, "manifest")
+		if err != nil {
+			t.Fatalf("ReadFile(\"manifest\"); err = %v", err)
+		}
+		var manifest Manifest
+		err = json.Unmarshal(manifestBuf, &manifest)
+		if err != nil {
+			t.Fatalf("json.Unmarshal(\"manifest\"); err = %v", err)
+		}
+		for _, skip := range manifest.Skipped {
+			t.Errorf("bundle %d; skipped %q: %v", i, skip.Name, skip.Error)
+		}
+		for _, rec := range manifest.Entries {
+			if rec.Name == "pprof/trace" && rec.End.Sub(rec.Start) > time.Second {
+				t.Errorf("bundle %d; trace took %s", i, rec.End.Sub(rec.Start))
+			}
+		}
+		_, err = fs.Stat(zr, "pprof/trace")
+		if err != nil {
+			t.Errorf("bundle %d; pprof/trace; err = %v", i, err)
+		}
+	}
+
+	// The recorder resumes once the tracer is free.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rf := fr.impl.(*rotatingFlightRecorder)
+		rf.mu.Lock()
+		running := rf.cur != nil
+		rf.mu.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorder did not resume")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
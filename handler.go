@@ -1,12 +1,14 @@
 package autoprof
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,20 +19,191 @@ import (
 // trace. A parameter send this way should be a positive floating point number
 // with an "s" suffix, to indicate units of "seconds".
 //
-// This http.Handler should be mounted at "/debug/profiles".
+// The "include" and "exclude" query parameters each hold a comma-separated
+// list of runtime/pprof profile and built-in data source names, as described
+// for the IncludeProfiles and ExcludeProfiles fields of ArchiveOptions. The "debug" query parameter
+// holds a comma-separated list of profile names and debug levels, each
+// separated by a colon, such as "goroutine:2".
+//
+// When the Handler has a FlightRecorder, the "flight" query parameter set to
+// "true" or "1" requests that the bundle's execution trace come from a snapshot
+// of the flight recorder's recent history, rather than a new trace.
+//
+// When the Handler has a Recent store, it serves the bundles in that store
+// without collecting a new one. A request for "/latest" under the Handler's
+// Prefix returns the newest bundle. A request for "/recent" under the Prefix
+// returns a JSON-encoded list of the bundles, newest first, and with the "key" query
+// parameter returns the bundle with that key.
+//
+// When the Handler has a Store, a request for "/history" under the Prefix
+// lists the bundles in that Store from the current process, or with the
+// "scope" query parameter set to "main", from every process of the current
+// program. The "since" and "until" query parameters, in RFC 3339 format, limit
+// the list to bundles captured in that time range. The list is JSON-encoded,
+// or with the "format" query parameter set to "html", a simple web page. With
+// the "key" query parameter, the request returns the bundle with that key.
+//
+// The Authorize, MaxDuration, and MaxConcurrent fields control who may use the
+// Handler and how much of the process's resources their requests may consume.
+// The Audit field records each request.
+//
+// This http.Handler should be mounted at its Prefix, "/debug/profiles" by
+// default, and also at that path with a trailing "/" when it has a Recent store
+// or a Store. It responds with status 404 to requests for other paths under
+// the Prefix, including those for the Recent store or Store when the Handler
+// doesn't have one.
 type Handler struct {
+	// Prefix is the path at which the Handler is mounted. If empty, it
+	// defaults to "/debug/profiles".
+	Prefix string
+
+	// FlightRecorder is an optional flight recorder, for requests that use the
+	// "flight" query parameter.
+	FlightRecorder *FlightRecorder
+
+	// Recent optionally holds recently-collected bundles, such as those from
+	// a periodic collector, for immediate retrieval.
+	Recent *MemoryStore
+
+	// Store optionally holds bundles that the process collected earlier, such
+	// as the Store of a periodic collector, for browsing and download.
+	Store Store
+
+	// Authorize, if set, decides whether to serve each request. It returns a
+	// description of the caller for the Audit hook, or an error to reject the
+	// request with status 401. See BearerToken.
+	Authorize func(r *http.Request) (string, error)
+	// MaxDuration, if set, limits the "profile" and "trace" query parameters.
+	// The Handler rejects requests for longer durations with status 400. It
+	// does not limit the "trace" parameter of a request that uses the
+	// "flight" parameter, which ignores it.
+	MaxDuration time.Duration
+	// MaxConcurrent, if set, limits the number of new bundles that this
+	// Handler may collect at once. When there are already that many, the
+	// Handler rejects the request with status 429. It does not limit requests
+	// for bundles from the Recent store or the Store.
+	MaxConcurrent int
+	// Audit, if set, receives a record of each request once the Handler has
+	// responded to it.
+	Audit func(rec *AuditRecord)
+
+	// active counts the new bundles that the Handler is collecting, for the
+	// MaxConcurrent limit.
+	active atomic.Int64
 }
 
 var _ http.Handler = (*Handler)(nil)
 
+const defaultHandlerPrefix = "/debug/profiles"
+
+// handlerProfilerWait limits how long a request will wait for another user of
+// the CPU profiler or execution tracer to finish.
+const handlerProfilerWait = 10 * time.Second
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+	rec := &AuditRecord{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		URL:        r.URL.String(),
+	}
+	if h.Audit != nil {
+		defer func() {
+			rec.Status = sw.status
+			if rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			rec.Duration = time.Since(rec.Time)
+			h.Audit(rec)
+		}()
+	}
+
+	if h.Authorize != nil {
+		identity, err := h.Authorize(r)
+		if err != nil {
+			rec.Err = err
+			http.Error(sw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rec.Identity = identity
+	}
+	rec.Err = h.serve(sw, r)
+}
+
+// serve responds to an authorized request. It returns any error that prevented
+// a complete response.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = defaultHandlerPrefix
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	var sub string
+	if rest := strings.TrimPrefix(r.URL.Path, prefix); rest != r.URL.Path && strings.HasPrefix(rest, "/") {
+		sub = rest
+	}
+	switch {
+	case sub == "" || sub == "/":
+		// Collect a new bundle.
+	case sub == "/latest" && h.Recent != nil:
+		h.serveLatest(w, r)
+		return nil
+	case sub == "/recent" && h.Recent != nil:
+		h.serveRecent(w, r)
+		return nil
+	case sub == "/history" && h.Store != nil:
+		h.serveHistory(w, r)
+		return nil
+	default:
+		// Rather than starting a collection that may be long and
+		// expensive, reject paths that the Handler can't serve.
+		err := fmt.Errorf("no profile bundles at %q", r.URL.Path)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
 	meta := CurrentArchiveMeta()
+	query := r.URL.Query()
 
 	opt := &ArchiveOptions{
 		// Include output of /debug/pprof/profile
-		CPUProfileDuration: parseWaitDuration(r.URL.Query().Get("profile")),
+		CPUProfileDuration: parseWaitDuration(query.Get("profile")),
 		// Include output of /debug/pprof/trace
-		ExecutionTraceDuration: parseWaitDuration(r.URL.Query().Get("trace")),
+		ExecutionTraceDuration: parseWaitDuration(query.Get("trace")),
+
+		IncludeProfiles: parseNameList(query["include"]),
+		ExcludeProfiles: parseNameList(query["exclude"]),
+		ProfileDebug:    parseProfileDebug(query["debug"]),
+
+		// The response headers are sent before collection begins, so there's
+		// little opportunity to report a failure. Include as much data as
+		// possible.
+		RecordErrors: true,
+		// Someone is waiting for this bundle. Take the profilers from any
+		// scheduled collection, but don't wait forever for another request.
+		Priority:     PriorityInteractive,
+		ProfilerWait: handlerProfilerWait,
+	}
+	if flight, _ := strconv.ParseBool(query.Get("flight")); flight && h.FlightRecorder != nil {
+		opt.FlightRecorder = h.FlightRecorder
+	}
+
+	traceDuration := opt.ExecutionTraceDuration
+	if opt.FlightRecorder != nil {
+		// The trace comes from the flight recorder instead.
+		traceDuration = 0
+	}
+	if limit := h.MaxDuration; limit > 0 && (opt.CPUProfileDuration > limit || traceDuration > limit) {
+		err := fmt.Errorf("requested duration exceeds the limit of %s", limit)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	active := h.active.Add(1)
+	defer h.active.Add(-1)
+	if h.MaxConcurrent > 0 && active > int64(h.MaxConcurrent) {
+		http.Error(w, errTooManyRequests.Error(), http.StatusTooManyRequests)
+		return errTooManyRequests
 	}
 
 	w.Header().Set("Content-Type", "application/zip")
@@ -44,6 +217,63 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// been sent
 		w.WriteHeader(http.StatusInternalServerError)
 	}
+	return err
+}
+
+// serveLatest responds with the newest bundle in the Recent store.
+func (h *Handler) serveLatest(w http.ResponseWriter, r *http.Request) {
+	meta, buf := h.Recent.Latest()
+	if meta == nil {
+		http.Error(w, "no recent profile bundles", http.StatusNotFound)
+		return
+	}
+	serveBundle(w, meta, buf)
+}
+
+// A recentBundle describes a bundle in the Recent store, for the "/recent"
+// listing.
+type recentBundle struct {
+	Key  string       `json:"key"`
+	Size int64        `json:"size"`
+	Meta *ArchiveMeta `json:"meta"`
+}
+
+// serveRecent responds with the bundle that the "key" query parameter names,
+// or otherwise with a list of the bundles in the Recent store.
+func (h *Handler) serveRecent(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	var list []*recentBundle
+	for _, b := range h.Recent.recent() {
+		if key != "" && b.sb.Key == key {
+			serveBundle(w, b.meta, b.buf)
+			return
+		}
+		list = append(list, &recentBundle{Key: b.sb.Key, Size: b.sb.Size, Meta: b.meta})
+	}
+	if key != "" {
+		http.Error(w, "profile bundle not found", http.StatusNotFound)
+		return
+	}
+
+	if list == nil {
+		list = []*recentBundle{}
+	}
+	buf, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
+
+// serveBundle responds with a bundle that's already been collected.
+func serveBundle(w http.ResponseWriter, meta *ArchiveMeta, buf []byte) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", downloadFileName(meta)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
 }
 
 func downloadFileName(meta *ArchiveMeta) string {
@@ -66,3 +296,41 @@ func parseWaitDuration(s string) time.Duration {
 	}
 	return time.Duration(v * float64(time.Second))
 }
+
+// parseNameList returns the non-empty names in the comma-separated lists of
+// values.
+func parseNameList(values []string) []string {
+	var names []string
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// parseProfileDebug returns the profile debug levels in the comma-separated
+// lists of values. Each element of a list is a profile name, a colon, and a
+// non-negative integer debug level.
+//
+// It ignores invalid elements.
+func parseProfileDebug(values []string) map[string]int {
+	var levels map[string]int
+	for _, name := range parseNameList(values) {
+		i := strings.LastIndex(name, ":")
+		if i <= 0 {
+			continue
+		}
+		level, err := strconv.Atoi(name[i+1:])
+		if err != nil || level < 0 {
+			continue
+		}
+		if levels == nil {
+			levels = make(map[string]int)
+		}
+		levels[name[:i]] = level
+	}
+	return levels
+}
@@ -3,9 +3,15 @@ package autoprof
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,6 +51,21 @@ func TestParseWaitDuration(t *testing.T) {
 	t.Run("", testcase("1s 2s", 0))
 }
 
+func TestParseProfileSelection(t *testing.T) {
+	if have, want := fmt.Sprint(parseNameList([]string{"heap,goroutine", "", "mutex,,"})),
+		fmt.Sprint([]string{"heap", "goroutine", "mutex"}); have != want {
+		t.Errorf("parseNameList; %s != %s", have, want)
+	}
+
+	if have, want := fmt.Sprint(parseProfileDebug([]string{"goroutine:2,heap:1", "bad", ":1", "mutex:-1", "block:x", "a:b:1"})),
+		fmt.Sprint(map[string]int{"goroutine": 2, "heap": 1, "a:b": 1}); have != want {
+		t.Errorf("parseProfileDebug; %s != %s", have, want)
+	}
+	if levels := parseProfileDebug(nil); levels != nil {
+		t.Errorf("parseProfileDebug(nil); %v != nil", levels)
+	}
+}
+
 func TestHandler(t *testing.T) {
 	srv := httptest.NewServer(&Handler{})
 	defer srv.Close()
@@ -76,3 +97,135 @@ func TestHandler(t *testing.T) {
 		t.Errorf("profile bundle zip did not include 'meta' file")
 	}
 }
+
+func TestHandlerProfileSelection(t *testing.T) {
+	srv := httptest.NewServer(&Handler{})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?include=heap,goroutine,allocs&exclude=allocs&debug=goroutine:1")
+	if err != nil {
+		t.Fatalf("http.Get; err = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll(resp.Body); err = %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("zip.NewReader; err = %v", err)
+	}
+
+	var profiles []string
+	for _, file := range zr.File {
+		if strings.HasPrefix(file.Name, "pprof/") {
+			profiles = append(profiles, file.Name)
+		}
+	}
+	if have, want := fmt.Sprint(profiles), fmt.Sprint([]string{"pprof/heap", "pprof/goroutine"}); have != want {
+		t.Errorf("profiles; %s != %s", have, want)
+	}
+
+	buf, err := fs.ReadFile(zr, "pprof/goroutine")
+	if err != nil {
+		t.Fatalf("ReadFile(\"pprof/goroutine\"); err = %v", err)
+	}
+	if !bytes.HasPrefix(buf, []byte("goroutine profile:")) {
+		t.Errorf("goroutine profile is not in debug=1 text format")
+	}
+}
+
+func TestHandlerRecent(t *testing.T) {
+	recent := &MemoryStore{}
+	mux := http.NewServeMux()
+	h := &Handler{Recent: recent}
+	mux.Handle("/debug/profiles", h)
+	mux.Handle("/debug/profiles/", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("http.Get; err = %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("io.ReadAll(resp.Body); err = %v", err)
+		}
+		return resp, body
+	}
+
+	if resp, _ := get("/debug/profiles/latest"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("latest from empty store; status %d", resp.StatusCode)
+	}
+
+	var metas []*ArchiveMeta
+	for i := 0; i < 2; i++ {
+		meta := CurrentArchiveMeta()
+		meta.CaptureTime = fmt.Sprintf("2021-03-04T05:06:0%d.000Z", i)
+		metas = append(metas, meta)
+		recent.Put(context.Background(), meta, []byte(fmt.Sprintf("bundle %d", i)))
+	}
+
+	resp, body := get("/debug/profiles/latest")
+	if have, want := string(body), "bundle 1"; have != want {
+		t.Errorf("latest; %q != %q", have, want)
+	}
+	if have, want := resp.Header.Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%q", downloadFileName(metas[1])); have != want {
+		t.Errorf("latest; Content-Disposition %q != %q", have, want)
+	}
+
+	_, body = get("/debug/profiles/recent")
+	var list []*recentBundle
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		t.Fatalf("json.Unmarshal; err = %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("recent; found %d bundles, expected 2", len(list))
+	}
+	if have, want := list[0].Meta.CaptureTime, metas[1].CaptureTime; have != want {
+		t.Errorf("recent; first bundle captured at %q, expected %q", have, want)
+	}
+
+	_, body = get("/debug/profiles/recent?key=" + url.QueryEscape(list[1].Key))
+	if have, want := string(body), "bundle 0"; have != want {
+		t.Errorf("recent by key; %q != %q", have, want)
+	}
+	if resp, _ := get("/debug/profiles/recent?key=missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("recent with unknown key; status %d", resp.StatusCode)
+	}
+
+	// Only the exact paths under the mount point serve the Recent store.
+	// The Handler doesn't know any others, and has no Store for "/history".
+	for _, path := range []string{"/debug/profiles/other/latest", "/debug/profiles/latest/", "/debug/profiles/history"} {
+		if resp, _ := get(path + "?include=heap"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s; status %d", path, resp.StatusCode)
+		}
+	}
+	// A request for the mount point itself collects a new bundle.
+	for _, path := range []string{"/debug/profiles", "/debug/profiles/"} {
+		_, body = get(path + "?include=heap")
+		if !bytes.HasPrefix(body, []byte("PK")) {
+			t.Errorf("%s; did not collect a new bundle", path)
+		}
+	}
+
+	// Without a Recent store, those paths are unknown too.
+	mux.Handle("/bare/", &Handler{Prefix: "/bare"})
+	for _, path := range []string{"/bare/latest", "/bare/recent"} {
+		if resp, _ := get(path + "?include=heap"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s without Recent; status %d", path, resp.StatusCode)
+		}
+	}
+
+	mux.Handle("/custom/", &Handler{Prefix: "/custom", Recent: recent})
+	_, body = get("/custom/latest")
+	if have, want := string(body), "bundle 1"; have != want {
+		t.Errorf("latest with Prefix; %q != %q", have, want)
+	}
+}
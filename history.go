@@ -0,0 +1,134 @@
+package autoprof
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// historyPrefix returns the prefix of the keys of the bundles in scope for a
+// "/history" request: those from the current process, or with scope "main",
+// from any process of the current program.
+func historyPrefix(meta *ArchiveMeta, scope string) (string, error) {
+	switch scope {
+	case "", "proc":
+		return strings.Join([]string{
+			url.PathEscape(meta.Main),
+			url.PathEscape(meta.Hostname),
+			url.PathEscape(meta.ProcID),
+		}, "/") + "/", nil
+	case "main":
+		return url.PathEscape(meta.Main) + "/", nil
+	}
+	return "", errors.New("scope must be \"proc\" or \"main\"")
+}
+
+// parseHistoryTime returns the time that the RFC 3339 value s represents, or
+// the zero time if s is empty.
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// serveHistory responds with the bundle that the "key" query parameter names,
+// or otherwise with a list of the bundles in the Store.
+func (h *Handler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, err := historyPrefix(CurrentArchiveMeta(), query.Get("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if key := query.Get("key"); key != "" {
+		sb, err := ParseBundleKey(key)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			http.Error(w, "profile bundle not found", http.StatusNotFound)
+			return
+		}
+		buf, err := h.Store.Get(r.Context(), key)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "profile bundle not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveBundle(w, &ArchiveMeta{
+			Main:        sb.Main,
+			Hostname:    sb.Hostname,
+			ProcID:      sb.ProcID,
+			CaptureTime: sb.CaptureTime,
+		}, buf)
+		return
+	}
+
+	since, err := parseHistoryTime(query.Get("since"))
+	if err != nil {
+		http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseHistoryTime(query.Get("until"))
+	if err != nil {
+		http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all, err := h.Store.List(r.Context(), prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := []*StoredBundle{}
+	for _, sb := range all {
+		t, err := time.Parse(time.RFC3339, sb.CaptureTime)
+		if err != nil {
+			// Without a capture time, the bundle can only match a listing
+			// without a time range.
+			if since.IsZero() && until.IsZero() {
+				list = append(list, sb)
+			}
+			continue
+		}
+		if (!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until)) {
+			continue
+		}
+		list = append(list, sb)
+	}
+
+	if query.Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		historyTemplate.Execute(w, struct {
+			Scope   string
+			Bundles []*StoredBundle
+		}{Scope: query.Get("scope"), Bundles: list})
+		return
+	}
+	buf, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
+
+var historyTemplate = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Profile bundles</title></head>
+<body>
+<table>
+<tr><th>Capture time</th><th>Program</th><th>Host</th><th>Process</th><th>Size</th></tr>
+{{range .Bundles}}<tr><td><a href="?scope={{$.Scope}}&amp;key={{.Key}}">{{.CaptureTime}}</a></td><td>{{.Main}}</td><td>{{.Hostname}}</td><td>{{.ProcID}}</td><td>{{.Size}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
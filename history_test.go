@@ -0,0 +1,114 @@
+package autoprof
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlerHistory(t *testing.T) {
+	store := &MemoryStore{}
+	put := func(meta *ArchiveMeta, captureTime string) *ArchiveMeta {
+		meta.CaptureTime = captureTime
+		store.Put(context.Background(), meta, []byte("bundle "+BundleKey(meta)))
+		return meta
+	}
+	cur := CurrentArchiveMeta()
+	early := put(cur.clone(), "2021-03-04T05:00:00.000Z")
+	late := put(cur.clone(), "2021-03-04T07:00:00.000Z")
+	other := cur.clone()
+	other.ProcID = "other-process"
+	put(other, "2021-03-04T06:00:00.000Z")
+	otherMain := cur.clone()
+	otherMain.Main = "example.com/other"
+	put(otherMain, "2021-03-04T06:00:00.000Z")
+
+	srv := httptest.NewServer(&Handler{Store: store})
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, string) {
+		resp, err := http.Get(srv.URL + "/debug/profiles/history" + query)
+		if err != nil {
+			t.Fatalf("http.Get; err = %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("io.ReadAll(resp.Body); err = %v", err)
+		}
+		return resp, string(body)
+	}
+	list := func(query string) string {
+		resp, body := get(query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("query %q; status %d", query, resp.StatusCode)
+		}
+		var list []*StoredBundle
+		err := json.Unmarshal([]byte(body), &list)
+		if err != nil {
+			t.Fatalf("query %q; json.Unmarshal; err = %v", query, err)
+		}
+		var names []string
+		for _, sb := range list {
+			names = append(names, sb.ProcID+"@"+sb.CaptureTime[11:13])
+		}
+		return fmt.Sprint(names)
+	}
+
+	pid := cur.ProcID
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"", fmt.Sprintf("[%s@05 %s@07]", pid, pid)},
+		{"?scope=main", fmt.Sprintf("[%s@05 %s@07 other-process@06]", pid, pid)},
+		{"?scope=main&since=2021-03-04T05:30:00Z", fmt.Sprintf("[%s@07 other-process@06]", pid)},
+		{"?scope=main&since=2021-03-04T05:30:00Z&until=2021-03-04T06:30:00Z", "[other-process@06]"},
+	} {
+		if have := list(tt.query); have != tt.want {
+			t.Errorf("query %q; %s != %s", tt.query, have, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?scope=host", "?since=yesterday"} {
+		if resp, _ := get(query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("query %q; status %d", query, resp.StatusCode)
+		}
+	}
+
+	resp, body := get("?format=html")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("html; Content-Type %q", ct)
+	}
+	// The template may choose either case for hex digits in the link.
+	if want := html.EscapeString("?scope=&key=" + url.QueryEscape(BundleKey(late))); !strings.Contains(strings.ToLower(body), strings.ToLower(want)) {
+		t.Errorf("html; no link to %q in\n%s", want, body)
+	}
+
+	resp, body = get("?key=" + url.QueryEscape(BundleKey(early)))
+	if have, want := body, "bundle "+BundleKey(early); have != want {
+		t.Errorf("download; %q != %q", have, want)
+	}
+	if have, want := resp.Header.Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%q", downloadFileName(early)); have != want {
+		t.Errorf("download; Content-Disposition %q != %q", have, want)
+	}
+
+	// Downloads are limited to the requested scope.
+	otherKey := url.QueryEscape(BundleKey(other))
+	if resp, _ := get("?key=" + otherKey); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download from another process; status %d", resp.StatusCode)
+	}
+	if resp, _ := get("?scope=main&key=" + otherKey); resp.StatusCode != http.StatusOK {
+		t.Errorf("download from another process with scope=main; status %d", resp.StatusCode)
+	}
+	if resp, _ := get("?scope=main&key=" + url.QueryEscape(BundleKey(otherMain))); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download from another program; status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,97 @@
+package autoprof
+
+import (
+	"time"
+)
+
+// A Manifest describes the work of assembling a profile bundle. In zip-archived
+// profile bundles, this structure will be JSON-encoded and stored as the final
+// file, named "manifest".
+type Manifest struct {
+	// Entries lists the files in the profile bundle, in order. It does not
+	// include the manifest itself.
+	Entries []*ManifestEntry `json:"entries"`
+	// Skipped lists the time-based profiles that the collector was asked to
+	// include in the profile bundle, but was unable to start.
+	Skipped []*SkippedProfile `json:"skipped,omitempty"`
+}
+
+// A ManifestEntry describes the collection of a single file within a profile
+// bundle.
+type ManifestEntry struct {
+	// Name is the name of the file within the profile bundle.
+	Name string `json:"name"`
+	// Start and End are the wall-clock times at which the collector began and
+	// finished gathering data for the file. For the CPU profile and execution
+	// trace, they bound the time that the profiler was active.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Bytes is the size of the file.
+	Bytes int64 `json:"bytes"`
+	// RequestedDuration is the duration that the collector was asked to run
+	// a time-based profile. It is zero for point-in-time profiles and other
+	// data. When JSON-encoded, it is an integer count of nanoseconds.
+	RequestedDuration time.Duration `json:"requested_duration,omitempty"`
+	// StopReason describes why the collector stopped a time-based profile,
+	// such as the CPU profile or execution trace. It is empty for point-in-
+	// time profiles and other data.
+	StopReason StopReason `json:"stop_reason,omitempty"`
+}
+
+// A SkippedProfile describes a time-based profile that the collector did not
+// include in a profile bundle.
+type SkippedProfile struct {
+	// Name is the name the file would have had within the profile bundle.
+	Name string `json:"name"`
+	// RequestedDuration is the duration that the collector was asked to run
+	// the profile. When JSON-encoded, it is an integer count of nanoseconds.
+	RequestedDuration time.Duration `json:"requested_duration"`
+	// Reason describes why the collector did not run the profile.
+	Reason SkipReason `json:"reason"`
+	// Error is the text of the error that prevented the profile from
+	// starting.
+	Error string `json:"error,omitempty"`
+}
+
+// A SkipReason describes why the collector did not run a time-based profile.
+type SkipReason string
+
+const (
+	// SkipBusy indicates that another part of the program, outside of
+	// DefaultCoordinator (such as a request to /debug/pprof/profile), was
+	// already using the profiler.
+	SkipBusy SkipReason = "busy"
+	// SkipPreempted indicates that a higher-priority user of
+	// DefaultCoordinator needed the profiler before the profile could start.
+	SkipPreempted SkipReason = "preempted"
+	// SkipWaitExpired indicates that DefaultCoordinator did not make the
+	// profiler available within the collection's ProfilerWait.
+	SkipWaitExpired SkipReason = "wait_expired"
+	// SkipCanceled indicates that the collection's context.Context was
+	// canceled while it waited for DefaultCoordinator to make the profiler
+	// available.
+	SkipCanceled SkipReason = "canceled"
+	// SkipNotRecording indicates that the collection's FlightRecorder had no
+	// execution trace to provide, such as because it was not running.
+	SkipNotRecording SkipReason = "not_recording"
+)
+
+// A StopReason describes why the collector stopped a time-based profile.
+type StopReason string
+
+const (
+	// StopDuration indicates that the profile ran for its full requested
+	// duration.
+	StopDuration StopReason = "duration"
+	// StopByteTarget indicates that the profile stopped early because its
+	// output reached the requested size target.
+	StopByteTarget StopReason = "byte_target"
+	// StopCanceled indicates that the profile stopped early because the
+	// collection's context.Context was canceled.
+	StopCanceled StopReason = "canceled"
+	// StopPreempted indicates that the profile stopped early because a
+	// higher-priority user of DefaultCoordinator needed the profiler, or
+	// because a background profile that runs indefinitely yielded it to
+	// another request. See Lease.Contended.
+	StopPreempted StopReason = "preempted"
+)
@@ -0,0 +1,165 @@
+package autoprof
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A MemoryStore is a Store which holds the most recent profile bundles in
+// memory, discarding the oldest when it reaches its limits. A Handler can
+// serve the bundles in a MemoryStore without waiting for a new collection.
+type MemoryStore struct {
+	// MaxCount limits the number of bundles in the store. If zero, it
+	// defaults to ten.
+	MaxCount int
+	// MaxBytes limits the total size of the bundles in the store. If zero,
+	// it defaults to 64 MiB. A negative value means no limit. The store
+	// always keeps the newest bundle, even if it alone exceeds the limit.
+	MaxBytes int64
+
+	mu sync.Mutex
+	// bundles holds the bundles in the order they arrived, oldest first.
+	bundles []*memBundle
+	size    int64
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+const (
+	defaultMemoryStoreCount = 10
+	defaultMemoryStoreBytes = 64 << 20
+)
+
+// A memBundle is a profile bundle held in a MemoryStore.
+type memBundle struct {
+	sb   *StoredBundle
+	meta *ArchiveMeta
+	buf  []byte
+}
+
+// Put adds the bundle to the store, discarding the oldest bundles as needed
+// to stay within the limits.
+func (s *MemoryStore) Put(ctx context.Context, meta *ArchiveMeta, bundle []byte) error {
+	key := BundleKey(meta)
+	b := &memBundle{
+		sb: &StoredBundle{
+			Key:         key,
+			Main:        meta.Main,
+			Hostname:    meta.Hostname,
+			ProcID:      meta.ProcID,
+			CaptureTime: meta.CaptureTime,
+			Size:        int64(len(bundle)),
+		},
+		meta: meta.clone(),
+		buf:  bundle,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	s.bundles = append(s.bundles, b)
+	s.size += b.sb.Size
+
+	maxCount := s.MaxCount
+	if maxCount <= 0 {
+		maxCount = defaultMemoryStoreCount
+	}
+	maxBytes := s.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMemoryStoreBytes
+	}
+	for len(s.bundles) > 1 &&
+		(len(s.bundles) > maxCount || (maxBytes > 0 && s.size > maxBytes)) {
+		s.size -= s.bundles[0].sb.Size
+		s.bundles[0] = nil
+		s.bundles = s.bundles[1:]
+	}
+	return nil
+}
+
+// List describes the bundles whose keys begin with prefix, ordered by key.
+func (s *MemoryStore) List(ctx context.Context, prefix string) ([]*StoredBundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*StoredBundle
+	for _, b := range s.bundles {
+		if strings.HasPrefix(b.sb.Key, prefix) {
+			sb := *b.sb
+			list = append(list, &sb)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// Get returns the contents of the bundle with the provided key.
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.find(key)
+	if b == nil {
+		return nil, fmt.Errorf("bundle %q: %w", key, fs.ErrNotExist)
+	}
+	return b.buf, nil
+}
+
+// Delete removes the bundle with the provided key.
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(key) {
+		return fmt.Errorf("bundle %q: %w", key, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// Latest returns the most recently stored bundle and the metadata that
+// describes it, or nil if the store is empty.
+func (s *MemoryStore) Latest() (*ArchiveMeta, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bundles) == 0 {
+		return nil, nil
+	}
+	b := s.bundles[len(s.bundles)-1]
+	return b.meta.clone(), b.buf
+}
+
+// recent returns the bundles in the store, newest first.
+func (s *MemoryStore) recent() []*memBundle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*memBundle, 0, len(s.bundles))
+	for i := len(s.bundles) - 1; i >= 0; i-- {
+		list = append(list, s.bundles[i])
+	}
+	return list
+}
+
+// find returns the bundle with the provided key, or nil. The caller must hold
+// s.mu.
+func (s *MemoryStore) find(key string) *memBundle {
+	for _, b := range s.bundles {
+		if b.sb.Key == key {
+			return b
+		}
+	}
+	return nil
+}
+
+// remove discards the bundle with the provided key, and reports whether it was
+// present. The caller must hold s.mu.
+func (s *MemoryStore) remove(key string) bool {
+	for i, b := range s.bundles {
+		if b.sb.Key == key {
+			s.size -= b.sb.Size
+			s.bundles = append(s.bundles[:i], s.bundles[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
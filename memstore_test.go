@@ -0,0 +1,113 @@
+package autoprof
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	meta := func(i int) *ArchiveMeta {
+		return &ArchiveMeta{Main: "main", ProcID: "proc", CaptureTime: fmt.Sprintf("t%d", i)}
+	}
+	keys := func(s *MemoryStore) string {
+		list, err := s.List(ctx, "")
+		if err != nil {
+			t.Fatalf("List; err = %v", err)
+		}
+		var keys []string
+		for _, sb := range list {
+			keys = append(keys, sb.CaptureTime)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	s := &MemoryStore{MaxCount: 3, MaxBytes: 100}
+	if meta, buf := s.Latest(); meta != nil || buf != nil {
+		t.Errorf("Latest; found a bundle in an empty store")
+	}
+	for i := 0; i < 4; i++ {
+		s.Put(ctx, meta(i), make([]byte, 10))
+	}
+	if have, want := keys(s), "[t1 t2 t3]"; have != want {
+		t.Errorf("after MaxCount; %s != %s", have, want)
+	}
+
+	s.Put(ctx, meta(4), make([]byte, 85))
+	if have, want := keys(s), "[t3 t4]"; have != want {
+		t.Errorf("after MaxBytes; %s != %s", have, want)
+	}
+	// The newest bundle stays, even alone over the limit.
+	s.Put(ctx, meta(5), make([]byte, 200))
+	if have, want := keys(s), "[t5]"; have != want {
+		t.Errorf("after large bundle; %s != %s", have, want)
+	}
+
+	latest, buf := s.Latest()
+	if latest == nil || latest.CaptureTime != "t5" || len(buf) != 200 {
+		t.Errorf("Latest; %+v with %d bytes", latest, len(buf))
+	}
+	buf, err := s.Get(ctx, BundleKey(meta(5)))
+	if err != nil || len(buf) != 200 {
+		t.Errorf("Get; %d bytes, err = %v", len(buf), err)
+	}
+
+	err = s.Delete(ctx, BundleKey(meta(5)))
+	if err != nil {
+		t.Errorf("Delete; err = %v", err)
+	}
+	_, err = s.Get(ctx, BundleKey(meta(5)))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get after Delete; err = %v, expected %v", err, fs.ErrNotExist)
+	}
+	err = s.Delete(ctx, BundleKey(meta(5)))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("second Delete; err = %v, expected %v", err, fs.ErrNotExist)
+	}
+
+	// By default, the store limits its size. A negative limit disables that.
+	large := make([]byte, 40<<20)
+	s = &MemoryStore{}
+	s.Put(ctx, meta(0), large)
+	s.Put(ctx, meta(1), large)
+	if have, want := keys(s), "[t1]"; have != want {
+		t.Errorf("default MaxBytes; %s != %s", have, want)
+	}
+	s = &MemoryStore{MaxBytes: -1}
+	s.Put(ctx, meta(0), large)
+	s.Put(ctx, meta(1), large)
+	if have, want := keys(s), "[t0 t1]"; have != want {
+		t.Errorf("unlimited MaxBytes; %s != %s", have, want)
+	}
+}
+
+func TestMemoryStoreLatest(t *testing.T) {
+	ctx := context.Background()
+	s := &MemoryStore{}
+
+	// A freshly-collected bundle is available right away, along with a copy
+	// of its metadata.
+	meta := CurrentArchiveMeta()
+	var buf bytes.Buffer
+	err := NewZipCollector(&buf, meta, &ArchiveOptions{IncludeProfiles: []string{"heap"}}).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	err = s.Put(ctx, meta, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Put; err = %v", err)
+	}
+	meta.Main = "changed"
+
+	latest, latestBuf := s.Latest()
+	if latest == nil || !bytes.Equal(latestBuf, buf.Bytes()) {
+		t.Fatalf("Latest; no bundle")
+	}
+	if have, want := latest.Main, CurrentArchiveMeta().Main; have != want {
+		t.Errorf("Latest; meta.Main %q != %q", have, want)
+	}
+}
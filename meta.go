@@ -1,11 +1,18 @@
 package autoprof
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"runtime"
 	"runtime/debug"
+	"runtime/metrics"
+	"sync"
 	"time"
 )
 
@@ -30,6 +37,11 @@ func generateArchiveMeta() (*ArchiveMeta, error) {
 		Main:      "",
 		Revision:  "",
 		GoVersion: runtime.Version(),
+		BuildID:   readBuildID(),
+
+		GOOS:   runtime.GOOS,
+		GOARCH: runtime.GOARCH,
+		NumCPU: runtime.NumCPU(),
 
 		Hostname: "",
 		ProcID:   procID,
@@ -39,6 +51,16 @@ func generateArchiveMeta() (*ArchiveMeta, error) {
 	if info, ok := debug.ReadBuildInfo(); ok {
 		meta.Main = info.Path
 		meta.Revision = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				meta.VCSRevision = setting.Value
+			case "vcs.time":
+				meta.VCSTime = setting.Value
+			case "vcs.modified":
+				meta.VCSModified = setting.Value
+			}
+		}
 	}
 
 	hostname, err := os.Hostname()
@@ -50,12 +72,36 @@ func generateArchiveMeta() (*ArchiveMeta, error) {
 	return meta, reterr
 }
 
-var baseMeta *ArchiveMeta
+var (
+	baseMetaMu sync.Mutex
+	baseMeta   *ArchiveMeta
+)
 
 func init() {
 	baseMeta, _ = generateArchiveMeta()
 }
 
+// UpdateBaseMeta changes the process-wide metadata that CurrentArchiveMeta
+// uses as the basis for each profile bundle. It calls fn with a copy of the
+// current base metadata, which fn may modify: to add Labels describing the
+// process's environment, as in
+//
+//	meta.Labels = meta.Labels.With("env", "production")
+//
+// or to override fields such as Hostname when the values that the package
+// discovers on its own are not meaningful.
+//
+// CurrentArchiveMeta sets the CaptureTime, GOMAXPROCS, GOGC, and GOMEMLIMIT
+// fields for each bundle, overwriting any changes fn makes to them.
+func UpdateBaseMeta(fn func(meta *ArchiveMeta)) {
+	baseMetaMu.Lock()
+	defer baseMetaMu.Unlock()
+
+	meta := baseMeta.clone()
+	fn(meta)
+	baseMeta = meta.clone()
+}
+
 // ArchiveMeta contains metadata about the current process, and about a
 // profile bundle. In zip-archived profile bundles, this structure will be
 // JSON-encoded and stored as a file named "meta".
@@ -64,11 +110,166 @@ type ArchiveMeta struct {
 	Revision  string `json:"revision"`
 	GoVersion string `json:"go_version"`
 
+	// VCSRevision, VCSTime, and VCSModified describe the version control
+	// checkout that the program was built from, as recorded by the go command
+	// in the "vcs.revision", "vcs.time", and "vcs.modified" build settings.
+	// They are empty when the build did not record that information.
+	VCSRevision string `json:"vcs_revision,omitempty"`
+	VCSTime     string `json:"vcs_time,omitempty"`
+	VCSModified string `json:"vcs_modified,omitempty"`
+	// BuildID is the Go build ID of the executable, as reported by "go tool
+	// buildid". It is empty if the executable could not be read.
+	BuildID string `json:"build_id,omitempty"`
+
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+	NumCPU int    `json:"num_cpu"`
+
+	// GOMAXPROCS, GOGC, and GOMEMLIMIT are the runtime's settings at the time
+	// of the capture. A GOGC value of -1 means "off". GOMEMLIMIT is in bytes,
+	// and is math.MaxInt64 when there is no limit. GOGC and GOMEMLIMIT are 0
+	// when the runtime does not report them.
+	GOMAXPROCS int   `json:"gomaxprocs"`
+	GOGC       int   `json:"gogc"`
+	GOMEMLIMIT int64 `json:"gomemlimit"`
+
 	Hostname string `json:"hostname"`
 	ProcID   string `json:"proc_id"`
 	InitTime string `json:"init_time"`
 
 	CaptureTime string `json:"capture_time"`
+
+	// Labels holds user-specified descriptions of the process, such as its
+	// deployment environment or region. See UpdateBaseMeta.
+	Labels Labels `json:"labels"`
+
+	// Overhead describes the measured cost of building recent bundles, when
+	// the collector is keeping to an overhead budget.
+	Overhead *Overhead `json:"overhead,omitempty"`
+
+	// Trigger describes the condition that prompted the collection of the
+	// profile bundle, when it was not part of a regular schedule.
+	Trigger *ArchiveTrigger `json:"trigger,omitempty"`
+}
+
+// An ArchiveTrigger describes the condition that prompted the collection of a
+// profile bundle.
+type ArchiveTrigger struct {
+	// Name identifies the trigger, such as "goroutines".
+	Name string `json:"name"`
+	// Value is the measurement that caused the trigger to fire, and Threshold
+	// is the limit that it reached.
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// Labels is a set of key-value pairs that describe a process. The zero value
+// has no labels. Labels values are immutable, and two with the same pairs are
+// equal when compared with ==, which keeps ArchiveMeta comparable.
+type Labels struct {
+	// enc is the JSON encoding of the pairs, with the keys in sorted order,
+	// or empty when there are none.
+	enc string
+}
+
+// NewLabels returns the Labels with the key-value pairs in m.
+func NewLabels(m map[string]string) Labels {
+	if len(m) == 0 {
+		return Labels{}
+	}
+	// encoding/json sorts map keys, so equal sets have equal encodings.
+	buf, _ := json.Marshal(m)
+	return Labels{enc: string(buf)}
+}
+
+// Map returns a copy of the key-value pairs, or nil if there are none.
+func (l Labels) Map() map[string]string {
+	if l.enc == "" {
+		return nil
+	}
+	var m map[string]string
+	json.Unmarshal([]byte(l.enc), &m)
+	return m
+}
+
+// Get returns the value for key, or "" if there is no such label.
+func (l Labels) Get(key string) string {
+	return l.Map()[key]
+}
+
+// Len returns the number of labels.
+func (l Labels) Len() int {
+	return len(l.Map())
+}
+
+// With returns a copy of the Labels with key set to value.
+func (l Labels) With(key, value string) Labels {
+	m := l.Map()
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return NewLabels(m)
+}
+
+// MarshalJSON encodes the Labels as a JSON object.
+func (l Labels) MarshalJSON() ([]byte, error) {
+	if l.enc == "" {
+		return []byte("{}"), nil
+	}
+	return []byte(l.enc), nil
+}
+
+// UnmarshalJSON decodes the Labels from a JSON object, or from null.
+func (l *Labels) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	*l = NewLabels(m)
+	return nil
+}
+
+// Overhead describes the cost of building profile bundles, relative to the
+// work that the rest of the process does.
+type Overhead struct {
+	// CPUBudget and AllocBudget are the largest fractions of the process's
+	// CPU time and of its allocated bytes that the collector aims to spend
+	// building bundles. Zero means no limit.
+	CPUBudget   float64 `json:"cpu_budget,omitempty"`
+	AllocBudget float64 `json:"alloc_budget,omitempty"`
+
+	// CPUFraction and AllocFraction are the measured costs of recent
+	// bundles, as a moving average of the fraction of the process's CPU time
+	// and allocated bytes.
+	CPUFraction   float64 `json:"cpu_fraction"`
+	AllocFraction float64 `json:"alloc_fraction"`
+
+	// PrevCPUSeconds, PrevAllocBytes, and PrevBundleBytes are the cost of
+	// building the previous bundle, and its size.
+	PrevCPUSeconds  float64 `json:"prev_cpu_seconds"`
+	PrevAllocBytes  uint64  `json:"prev_alloc_bytes"`
+	PrevBundleBytes int64   `json:"prev_bundle_bytes"`
+
+	// Scale is the factor by which the collector has stretched its schedule
+	// to stay within the budget. A value of 1 means it follows its schedule
+	// as configured.
+	Scale float64 `json:"scale"`
+}
+
+// clone returns a deep copy of the ArchiveMeta.
+func (m *ArchiveMeta) clone() *ArchiveMeta {
+	meta := *m
+	if m.Overhead != nil {
+		o := *m.Overhead
+		meta.Overhead = &o
+	}
+	if m.Trigger != nil {
+		t := *m.Trigger
+		meta.Trigger = &t
+	}
+	return &meta
 }
 
 // CurrentArchiveMeta returns the ArchiveMeta value for a profile bundle
@@ -76,9 +277,103 @@ type ArchiveMeta struct {
 func CurrentArchiveMeta() *ArchiveMeta {
 	now := time.Now().UTC()
 
-	meta := *baseMeta
+	baseMetaMu.Lock()
+	meta := baseMeta.clone()
+	baseMetaMu.Unlock()
+
 	meta.CaptureTime = now.Format(rfc3339milli)
-	return &meta
+	meta.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	meta.GOGC, meta.GOMEMLIMIT = readGCSettings()
+	return meta
+}
+
+// readGCSettings returns the current values of the GOGC and GOMEMLIMIT
+// settings, or zero if the runtime does not report them.
+func readGCSettings() (gogc int, gomemlimit int64) {
+	samples := []metrics.Sample{
+		{Name: "/gc/gogc:percent"},
+		{Name: "/gc/gomemlimit:bytes"},
+	}
+	metrics.Read(samples)
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		// The runtime reports "off" as -1, converted to uint64.
+		gogc = int(int64(v.Uint64()))
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindUint64 {
+		gomemlimit = int64(v.Uint64())
+	}
+	return gogc, gomemlimit
+}
+
+// readBuildID returns the Go build ID of the running executable, or the empty
+// string if it is unavailable.
+func readBuildID() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// On ELF systems, the linker stores the build ID in a note.
+	if ef, err := elf.NewFile(f); err == nil {
+		if sect := ef.Section(".note.go.buildid"); sect != nil {
+			buf, err := sect.Data()
+			if err != nil {
+				return ""
+			}
+			return parseBuildIDNote(buf, ef.ByteOrder)
+		}
+		return ""
+	}
+
+	// Otherwise, the linker stores it near the start of the text segment.
+	buf := make([]byte, 32<<10)
+	n, _ := io.ReadFull(f, buf)
+	return parseBuildIDText(buf[:n])
+}
+
+// parseBuildIDNote returns the Go build ID from the contents of the
+// ".note.go.buildid" ELF section.
+func parseBuildIDNote(buf []byte, order binary.ByteOrder) string {
+	const (
+		noteName   = "Go\x00\x00"
+		noteHeader = 12
+	)
+	if len(buf) < noteHeader+len(noteName) {
+		return ""
+	}
+	nameSize, descSize := order.Uint32(buf[0:]), order.Uint32(buf[4:])
+	if nameSize != uint32(len(noteName)) || string(buf[noteHeader:noteHeader+len(noteName)]) != noteName {
+		return ""
+	}
+	desc := buf[noteHeader+len(noteName):]
+	if uint64(descSize) > uint64(len(desc)) {
+		return ""
+	}
+	return string(desc[:descSize])
+}
+
+// parseBuildIDText returns the Go build ID from the raw bytes at the start of
+// an executable's text segment.
+func parseBuildIDText(buf []byte) string {
+	const (
+		prefix = "\xff Go build ID: \""
+		suffix = "\"\n \xff"
+	)
+	i := bytes.Index(buf, []byte(prefix))
+	if i < 0 {
+		return ""
+	}
+	buf = buf[i+len(prefix):]
+	j := bytes.Index(buf, []byte(suffix))
+	if j < 0 {
+		return ""
+	}
+	return string(buf[:j])
 }
 
 // selectSource is a math/rand.Source PRNG based on the randomness in select
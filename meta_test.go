@@ -0,0 +1,106 @@
+package autoprof
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUpdateBaseMetaSingleLabel(t *testing.T) {
+	baseMetaMu.Lock()
+	orig := baseMeta
+	baseMeta, _ = generateArchiveMeta()
+	baseMetaMu.Unlock()
+	defer func() {
+		baseMetaMu.Lock()
+		baseMeta = orig
+		baseMetaMu.Unlock()
+	}()
+
+	// A fresh base has no labels, but fn may still add one.
+	UpdateBaseMeta(func(meta *ArchiveMeta) {
+		meta.Labels = meta.Labels.With("env", "prod")
+	})
+	if have, want := CurrentArchiveMeta().Labels.Get("env"), "prod"; have != want {
+		t.Errorf("Labels[env]; %q != %q", have, want)
+	}
+}
+
+func TestUpdateBaseMeta(t *testing.T) {
+	baseMetaMu.Lock()
+	orig := baseMeta
+	baseMetaMu.Unlock()
+	defer func() {
+		baseMetaMu.Lock()
+		baseMeta = orig
+		baseMetaMu.Unlock()
+	}()
+
+	labels := map[string]string{"region": "us-west-2"}
+	UpdateBaseMeta(func(meta *ArchiveMeta) {
+		meta.Main = "example.com/service"
+		meta.Hostname = "pod-1234"
+		meta.Labels = NewLabels(labels)
+	})
+	// The package should keep its own copy of the labels.
+	labels["region"] = "modified"
+
+	meta := CurrentArchiveMeta()
+	if have, want := meta.Hostname, "pod-1234"; have != want {
+		t.Errorf("Hostname; %q != %q", have, want)
+	}
+	if have, want := meta.Labels.Get("region"), "us-west-2"; have != want {
+		t.Errorf("Labels[region]; %q != %q", have, want)
+	}
+	if have, want := meta.ProcID, orig.ProcID; have != want {
+		t.Errorf("ProcID; %q != %q", have, want)
+	}
+	if name := downloadFileName(meta); !strings.HasPrefix(name, "profile_service_") {
+		t.Errorf("downloadFileName; %q does not use the overridden Main", name)
+	}
+
+	// Changes to one ArchiveMeta value should not affect others.
+	meta.Labels = meta.Labels.With("region", "modified")
+	if have, want := CurrentArchiveMeta().Labels.Get("region"), "us-west-2"; have != want {
+		t.Errorf("Labels[region]; %q != %q", have, want)
+	}
+
+	UpdateBaseMeta(func(meta *ArchiveMeta) {
+		meta.Labels = meta.Labels.With("env", "production")
+	})
+	if have, want := CurrentArchiveMeta().Labels.Len(), 2; have != want {
+		t.Errorf("Labels; %d != %d", have, want)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	// Labels with the same pairs are equal, however they were built.
+	a := NewLabels(map[string]string{"env": "prod", "region": "us-west-2"})
+	b := Labels{}.With("region", "us-west-2").With("env", "prod")
+	if a != b {
+		t.Errorf("Labels; %v != %v", a, b)
+	}
+	if (Labels{}) != NewLabels(nil) || (Labels{}) != NewLabels(map[string]string{}) {
+		t.Errorf("empty Labels are not equal")
+	}
+
+	buf, err := json.Marshal(&ArchiveMeta{Labels: a})
+	if err != nil {
+		t.Fatalf("json.Marshal; err = %v", err)
+	}
+	var meta ArchiveMeta
+	err = json.Unmarshal(buf, &meta)
+	if err != nil {
+		t.Fatalf("json.Unmarshal; err = %v", err)
+	}
+	if meta.Labels != a {
+		t.Errorf("Labels after JSON; %v != %v", meta.Labels, a)
+	}
+
+	// Bundles from before labels have none.
+	meta = ArchiveMeta{}
+	err = json.Unmarshal([]byte(`{"main": "example.com/service"}`), &meta)
+	if err != nil || meta.Labels.Len() != 0 {
+		t.Errorf("Labels from old meta; %v, err = %v", meta.Labels.Map(), err)
+	}
+}
@@ -0,0 +1,150 @@
+package autoprof
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"time"
+)
+
+// A MetricsSnapshot holds the value of every runtime/metrics metric at a single
+// point in time. In zip-archived profile bundles, a list of these (one from the
+// start of the CPU profile and execution trace, and one from the end) will be
+// JSON-encoded and stored as a file named "runtime/metrics". The
+// IncludeProfiles and ExcludeProfiles options refer to that data source by the
+// same name.
+type MetricsSnapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+	// Samples holds the metrics, in the order that runtime/metrics.All
+	// describes them.
+	Samples []*MetricSample `json:"samples"`
+}
+
+// A MetricSample is the value of a single runtime/metrics metric. Exactly one
+// of its value fields is set, according to the metric's kind.
+type MetricSample struct {
+	// Name is the name of the metric, such as "/sched/goroutines:goroutines".
+	Name string `json:"name"`
+
+	Uint64    *uint64          `json:"uint64,omitempty"`
+	Float64   *MetricFloat     `json:"float64,omitempty"`
+	Histogram *MetricHistogram `json:"histogram,omitempty"`
+}
+
+// A MetricHistogram is the value of a runtime/metrics metric of kind
+// KindFloat64Histogram.
+type MetricHistogram struct {
+	// Counts holds the number of observations in each bucket.
+	Counts []uint64 `json:"counts"`
+	// Buckets holds the boundaries between the buckets, and has one more
+	// element than Counts. The first and last elements may be infinite.
+	Buckets []MetricFloat `json:"buckets"`
+}
+
+// A MetricFloat is a float64 that can hold infinite and NaN values when
+// JSON-encoded. It encodes those values as the strings "+Inf", "-Inf", and
+// "NaN", and all others as JSON numbers.
+type MetricFloat float64
+
+// MarshalJSON encodes f as a JSON number, or as a string if it is infinite or
+// NaN.
+func (f MetricFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a JSON number, or a string that MarshalJSON would
+// write, into f.
+func (f *MetricFloat) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*f = MetricFloat(v)
+		return nil
+	}
+	var v float64
+	err := json.Unmarshal(buf, &v)
+	if err != nil {
+		return err
+	}
+	*f = MetricFloat(v)
+	return nil
+}
+
+// metricsSourceName is the name of the built-in data source that records
+// runtime/metrics, both within the profile bundle and in the IncludeProfiles
+// and ExcludeProfiles options.
+const metricsSourceName = "runtime/metrics"
+
+// A metricsSource is the built-in data source for runtime/metrics. It collects
+// a snapshot each time the collector calls take, and writes all of them.
+type metricsSource struct {
+	snapshots []*MetricsSnapshot
+}
+
+// take adds a snapshot of the current metrics.
+func (s *metricsSource) take() {
+	s.snapshots = append(s.snapshots, takeMetricsSnapshot())
+}
+
+// WriteTo writes the snapshots as a JSON-encoded list.
+func (s *metricsSource) WriteTo(ctx context.Context, w io.Writer) error {
+	return jsonSource(s.snapshots).WriteTo(ctx, w)
+}
+
+// takeMetricsSnapshot reads all of the metrics that the runtime supports.
+func takeMetricsSnapshot() *MetricsSnapshot {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i := range descs {
+		samples[i].Name = descs[i].Name
+	}
+	metrics.Read(samples)
+
+	snap := &MetricsSnapshot{
+		Time:    time.Now(),
+		Samples: make([]*MetricSample, 0, len(samples)),
+	}
+	for _, sample := range samples {
+		ms := &MetricSample{Name: sample.Name}
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			v := sample.Value.Uint64()
+			ms.Uint64 = &v
+		case metrics.KindFloat64:
+			v := MetricFloat(sample.Value.Float64())
+			ms.Float64 = &v
+		case metrics.KindFloat64Histogram:
+			h := sample.Value.Float64Histogram()
+			mh := &MetricHistogram{
+				Counts:  append([]uint64(nil), h.Counts...),
+				Buckets: make([]MetricFloat, len(h.Buckets)),
+			}
+			for i, v := range h.Buckets {
+				mh.Buckets[i] = MetricFloat(v)
+			}
+			ms.Histogram = mh
+		default:
+			// The metric is not supported by this version of the runtime, or
+			// is of a kind that this package does not yet understand.
+			continue
+		}
+		snap.Samples = append(snap.Samples, ms)
+	}
+	return snap
+}
@@ -0,0 +1,94 @@
+package autoprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMetricFloat(t *testing.T) {
+	values := []float64{0, 1.5, -2, math.Inf(1), math.Inf(-1), math.NaN()}
+	in := make([]MetricFloat, len(values))
+	for i, v := range values {
+		in[i] = MetricFloat(v)
+	}
+
+	buf, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("json.Marshal; err = %v", err)
+	}
+	if have, want := string(buf), `[0,1.5,-2,"+Inf","-Inf","NaN"]`; have != want {
+		t.Errorf("json.Marshal; %s != %s", have, want)
+	}
+
+	var out []MetricFloat
+	err = json.Unmarshal(buf, &out)
+	if err != nil {
+		t.Fatalf("json.Unmarshal; err = %v", err)
+	}
+	for i, v := range out {
+		if have, want := float64(v), values[i]; have != want && !(math.IsNaN(have) && math.IsNaN(want)) {
+			t.Errorf("value %d; %v != %v", i, have, want)
+		}
+	}
+}
+
+func TestCollectorMetrics(t *testing.T) {
+	c := NewZipCollector(new(bytes.Buffer), CurrentArchiveMeta(), &ArchiveOptions{
+		ExecutionTraceDuration: 10 * time.Millisecond,
+	})
+	err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+
+	var found bool
+	for _, rec := range c.Manifest().Entries {
+		found = found || rec.Name == "runtime/metrics"
+	}
+	if !found {
+		t.Fatalf("bundle does not include runtime/metrics")
+	}
+
+	// It's possible to leave out runtime/metrics, like a profile.
+	c = NewZipCollector(new(bytes.Buffer), CurrentArchiveMeta(), &ArchiveOptions{
+		ExcludeProfiles: []string{"runtime/metrics"},
+	})
+	err = c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	for _, rec := range c.Manifest().Entries {
+		if rec.Name == "runtime/metrics" {
+			t.Errorf("bundle includes excluded runtime/metrics")
+		}
+	}
+
+	snap := takeMetricsSnapshot()
+	kinds := make(map[string]string)
+	for _, s := range snap.Samples {
+		switch {
+		case s.Uint64 != nil:
+			kinds[s.Name] = "uint64"
+		case s.Float64 != nil:
+			kinds[s.Name] = "float64"
+		case s.Histogram != nil:
+			kinds[s.Name] = "histogram"
+			if have, want := len(s.Histogram.Buckets), len(s.Histogram.Counts)+1; have != want {
+				t.Errorf("metric %q; %d buckets != %d", s.Name, have, want)
+			}
+		}
+	}
+	if have, want := kinds["/sched/goroutines:goroutines"], "uint64"; have != want {
+		t.Errorf("goroutine count; kind %q != %q", have, want)
+	}
+	if have, want := kinds["/sched/latencies:seconds"], "histogram"; have != want {
+		t.Errorf("scheduler latency; kind %q != %q", have, want)
+	}
+	if _, err := json.Marshal(snap); err != nil {
+		t.Errorf("json.Marshal; err = %v", err)
+	}
+}
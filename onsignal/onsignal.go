@@ -0,0 +1,133 @@
+// Package onsignal collects a profile bundle when the process receives a
+// signal, for programs that don't serve HTTP requests.
+package onsignal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// A Capturer collects a profile bundle each time the process receives a
+// signal. It ignores signals that arrive while it's collecting a bundle, and
+// those that arrive too soon after the previous one.
+type Capturer struct {
+	// Signal is the signal to watch for. If nil, it defaults to SIGUSR1 on
+	// Unix systems. Other systems have no default.
+	Signal os.Signal
+
+	// Options, if set, describes what to include in each bundle. A Capturer
+	// sets the RecordErrors field of its own copy. When Options is nil, it
+	// uses autoprof.DefaultArchiveOptions.
+	Options *autoprof.ArchiveOptions
+
+	// Store receives each profile bundle. To write the bundles to a local
+	// directory, use a periodic.DirStore.
+	Store autoprof.Store
+
+	// Debounce is the minimum time from the start of one bundle to the start
+	// of the next. If zero, it defaults to one second. A negative value means
+	// no minimum.
+	Debounce time.Duration
+
+	// OnError, if set, receives each error from building or storing a bundle,
+	// and the Capturer continues. By default, Run returns the first such
+	// error.
+	OnError func(err error)
+}
+
+const defaultDebounce = 1 * time.Second
+
+var (
+	errNoSignal = errors.New("onsignal: no signal specified")
+	errNoStore  = errors.New("onsignal: no Store specified")
+)
+
+// Run watches for the signal until the context ends. While it runs, the
+// signal no longer has its default behavior.
+func (c *Capturer) Run(ctx context.Context) error {
+	sig := c.Signal
+	if sig == nil {
+		sig = defaultSignal
+	}
+	if sig == nil {
+		return errNoSignal
+	}
+	if c.Store == nil {
+		return errNoStore
+	}
+	debounce := c.Debounce
+	if debounce == 0 {
+		debounce = defaultDebounce
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	defer signal.Stop(ch)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// done receives the outcome of each capture. While a capture is in
+	// progress, running is set.
+	done := make(chan error, 1)
+	running := false
+	defer func() {
+		if running {
+			<-done
+		}
+	}()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-done:
+			running = false
+			if err != nil && ctx.Err() == nil {
+				if c.OnError == nil {
+					return err
+				}
+				c.OnError(err)
+			}
+		case <-ch:
+			now := time.Now()
+			if running || (debounce > 0 && !last.IsZero() && now.Sub(last) < debounce) {
+				continue
+			}
+			last = now
+			running = true
+			go func() { done <- c.capture(ctx, sig) }()
+		}
+	}
+}
+
+// capture collects a profile bundle on behalf of the signal, and stores it.
+func (c *Capturer) capture(ctx context.Context, sig os.Signal) error {
+	meta := autoprof.CurrentArchiveMeta()
+	meta.Trigger = &autoprof.ArchiveTrigger{Name: "signal:" + sig.String()}
+
+	opts := autoprof.DefaultArchiveOptions()
+	if c.Options != nil {
+		*opts = *c.Options
+		opts.RecordErrors = true
+	}
+
+	var buf bytes.Buffer
+	err := autoprof.NewZipCollector(&buf, meta, opts).Run(ctx)
+	if err != nil {
+		return fmt.Errorf("onsignal: %w", err)
+	}
+	err = c.Store.Put(ctx, meta, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("onsignal: store bundle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+//go:build unix
+
+package onsignal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+// blockingStore is an autoprof.Store which reports each call to Put, and
+// then waits for permission to finish.
+type blockingStore struct {
+	autoprof.Store
+
+	mu      sync.Mutex
+	metas   []*autoprof.ArchiveMeta
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	_, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.metas = append(s.metas, meta)
+	s.mu.Unlock()
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.metas)
+}
+
+// signalUntil sends the signal to the process until the store starts a Put.
+func signalUntil(t *testing.T, sig syscall.Signal, store *blockingStore) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		err := syscall.Kill(os.Getpid(), sig)
+		if err != nil {
+			t.Fatalf("syscall.Kill; err = %v", err)
+		}
+		select {
+		case <-store.started:
+			return
+		case <-deadline:
+			t.Fatalf("signal did not prompt a bundle")
+		case <-tick.C:
+		}
+	}
+}
+
+func TestCapturer(t *testing.T) {
+	const sig = syscall.SIGUSR2
+
+	// Keep the signal from ending the test process, whether or not the
+	// Capturer is listening for it.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, sig)
+	defer signal.Stop(guard)
+
+	store := &blockingStore{started: make(chan struct{}), release: make(chan struct{})}
+	c := &Capturer{
+		Signal:   sig,
+		Options:  &autoprof.ArchiveOptions{IncludeProfiles: []string{"heap"}},
+		Store:    store,
+		Debounce: -1,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(ctx) }()
+
+	signalUntil(t, sig, store)
+
+	// Signals that arrive during a capture do not start another.
+	for i := 0; i < 3; i++ {
+		syscall.Kill(os.Getpid(), sig)
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(store.release)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-store.started:
+		t.Fatalf("started a second capture during the first")
+	default:
+	}
+
+	signalUntil(t, sig, store)
+	cancel()
+	<-errs
+
+	if have, want := store.count(), 2; have != want {
+		t.Errorf("bundles; %d != %d", have, want)
+	}
+	for _, meta := range store.metas {
+		if meta.Trigger == nil || meta.Trigger.Name != "signal:"+sig.String() {
+			t.Errorf("meta trigger; %#v", meta.Trigger)
+		}
+	}
+}
+
+func TestCapturerDebounce(t *testing.T) {
+	const sig = syscall.SIGUSR2
+
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, sig)
+	defer signal.Stop(guard)
+
+	store := &blockingStore{started: make(chan struct{}, 10), release: make(chan struct{})}
+	close(store.release)
+	c := &Capturer{
+		Signal:   sig,
+		Options:  &autoprof.ArchiveOptions{IncludeProfiles: []string{"heap"}},
+		Store:    store,
+		Debounce: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(ctx) }()
+
+	signalUntil(t, sig, store)
+	for i := 0; i < 3; i++ {
+		syscall.Kill(os.Getpid(), sig)
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	<-errs
+
+	if have, want := store.count(), 1; have != want {
+		t.Errorf("bundles; %d != %d", have, want)
+	}
+}
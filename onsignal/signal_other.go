@@ -0,0 +1,9 @@
+//go:build !unix
+
+package onsignal
+
+import "os"
+
+// defaultSignal is nil, since there's no conventional signal for this purpose
+// outside of Unix systems.
+var defaultSignal os.Signal
@@ -0,0 +1,10 @@
+//go:build unix
+
+package onsignal
+
+import (
+	"os"
+	"syscall"
+)
+
+var defaultSignal os.Signal = syscall.SIGUSR1
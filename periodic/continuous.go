@@ -0,0 +1,157 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// ContinuousCPU configures a Collector to run CPU profiles back-to-back, so
+// that together they cover nearly all of the process's lifetime. The Collector
+// includes the windows that finished since the previous bundle in each new
+// bundle, in place of that bundle's own CPU profile. For one window per bundle,
+// set the Schedule's Interval to match the Window. When Run's context ends,
+// the Collector stores one last bundle with the windows that remain, including
+// the partial window that was in progress.
+//
+// The continuous profiler holds the CPU profiler with background priority. It
+// yields to any other request for the CPU profiler, such as those from
+// autoprof.Handler, and resumes when they finish. That includes the Collector's
+// own bundles with an execution trace: those run their own CPU profile, so the
+// trace includes CPU samples.
+type ContinuousCPU struct {
+	// Window is the duration of each CPU profile. If zero, it defaults to
+	// ten seconds.
+	Window time.Duration
+	// MaxWindows limits the number of finished windows that wait for the next
+	// bundle. When there are too many, the Collector discards the oldest. If
+	// zero, it defaults to 64.
+	MaxWindows int
+}
+
+const (
+	defaultContinuousWindow     = 10 * time.Second
+	defaultContinuousMaxWindows = 64
+)
+
+// windowBuffer holds the finished CPU profile windows until the next bundle.
+type windowBuffer struct {
+	mu      sync.Mutex
+	max     int
+	windows []*autoprof.ProfileWindow
+}
+
+func (b *windowBuffer) add(w *autoprof.ProfileWindow) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.windows = append(b.windows, w)
+	if over := len(b.windows) - b.max; over > 0 {
+		b.windows = append([]*autoprof.ProfileWindow(nil), b.windows[over:]...)
+	}
+}
+
+func (b *windowBuffer) take() []*autoprof.ProfileWindow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	windows := b.windows
+	b.windows = nil
+	return windows
+}
+
+// startContinuous begins running back-to-back CPU profiles in the background.
+// The returned function waits for the profiler to stop, once the context
+// ends.
+func (r *runner) startContinuous(ctx context.Context) (wait func()) {
+	cc := r.c.ContinuousCPU
+	window := cc.Window
+	if window <= 0 {
+		window = defaultContinuousWindow
+	}
+	max := cc.MaxWindows
+	if max <= 0 {
+		max = defaultContinuousMaxWindows
+	}
+	r.windows = &windowBuffer{max: max}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.CPUProfiler, autoprof.PriorityBackground)
+			if err != nil {
+				return
+			}
+			profileWindows(ctx, lease, window, r.windows.add)
+			lease.Release()
+		}
+	}()
+	return func() { <-done }
+}
+
+// flushWindows stores a bundle with the CPU profile windows that have not yet
+// appeared in one, such as the partial window that ends when Run's context
+// does. It counts against the Collector's DrainTimeout.
+func (r *runner) flushWindows() {
+	windows := r.windows.take()
+	if len(windows) == 0 {
+		return
+	}
+	ctx, cancel := r.drainContext()
+	defer cancel()
+
+	opts := autoprof.DefaultArchiveOptions()
+	opts.CPUProfileDuration = 0
+	opts.Priority = autoprof.PriorityBackground
+	opts.CPUProfileWindows = windows
+	err := r.store(ctx, opts)
+	if err != nil {
+		r.reportErr(err)
+	}
+}
+
+// profileWindows runs CPU profiles of the requested duration, one after the
+// other, until the context ends or another user of the CPU profiler preempts
+// or contends for the lease.
+func profileWindows(ctx context.Context, lease *autoprof.Lease, window time.Duration, add func(*autoprof.ProfileWindow)) {
+	for {
+		var buf bytes.Buffer
+		start := time.Now()
+		err := pprof.StartCPUProfile(&buf)
+		t := time.NewTimer(window)
+		reason := autoprof.StopDuration
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			reason = autoprof.StopCanceled
+		case <-lease.Preempted():
+			reason = autoprof.StopPreempted
+		case <-lease.Contended():
+			reason = autoprof.StopPreempted
+		}
+		t.Stop()
+		if err != nil {
+			// Something that doesn't use autoprof.DefaultCoordinator is
+			// using the CPU profiler. Try again after a full window.
+			if reason != autoprof.StopDuration {
+				return
+			}
+			continue
+		}
+		pprof.StopCPUProfile()
+
+		add(&autoprof.ProfileWindow{
+			Start:             start,
+			End:               time.Now(),
+			RequestedDuration: window,
+			StopReason:        reason,
+			Profile:           buf.Bytes(),
+		})
+		if reason != autoprof.StopDuration {
+			return
+		}
+	}
+}
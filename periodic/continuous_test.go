@@ -0,0 +1,158 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+func TestContinuousCPU(t *testing.T) {
+	if err := pprof.StartCPUProfile(new(bytes.Buffer)); err != nil {
+		t.Skipf("CPU profiler is unavailable: %v", err)
+	}
+	pprof.StopCPUProfile()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const window = 20 * time.Millisecond
+	r := &runner{c: &Collector{ContinuousCPU: &ContinuousCPU{Window: window, MaxWindows: 100}}}
+	wait := r.startContinuous(ctx)
+
+	time.Sleep(10 * window)
+	// An interactive request interrupts the current window.
+	lease, err := autoprof.DefaultCoordinator.Acquire(ctx, autoprof.CPUProfiler, autoprof.PriorityInteractive)
+	if err != nil {
+		t.Fatalf("Acquire; err = %v", err)
+	}
+	lease.Release()
+	time.Sleep(5 * window)
+	cancel()
+	wait()
+
+	windows := r.windows.take()
+	if len(windows) < 5 {
+		t.Fatalf("found %d windows", len(windows))
+	}
+	var preempted int
+	for i, w := range windows {
+		if len(w.Profile) == 0 {
+			t.Errorf("window %d is empty", i)
+		}
+		if w.StopReason == autoprof.StopPreempted {
+			preempted++
+		}
+		if i > 0 && w.Start.Before(windows[i-1].End) {
+			t.Errorf("window %d starts before the previous one ends", i)
+		}
+	}
+	if preempted != 1 {
+		t.Errorf("found %d preempted windows, expected 1", preempted)
+	}
+
+	// The windows go into the next bundle, with their times in the manifest.
+	var buf bytes.Buffer
+	err = autoprof.NewZipCollector(&buf, autoprof.CurrentArchiveMeta(), &autoprof.ArchiveOptions{
+		IncludeProfiles:   []string{"goroutine"},
+		CPUProfileWindows: windows[:3],
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+	b, err := bundle.Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("bundle.Open; err = %v", err)
+	}
+	if have, want := len(b.CPUProfileWindows), 3; have != want {
+		t.Fatalf("bundle has %d windows, expected %d", have, want)
+	}
+	for i, e := range b.CPUProfileWindows {
+		if have, want := e.Name, fmt.Sprint(i); have != want {
+			t.Errorf("window name %q != %q", have, want)
+		}
+		for _, rec := range b.Manifest.Entries {
+			if rec.Name == e.Path && (!rec.Start.Equal(windows[i].Start) || !rec.End.Equal(windows[i].End)) {
+				t.Errorf("manifest entry %q has times %s-%s, expected %s-%s",
+					rec.Name, rec.Start, rec.End, windows[i].Start, windows[i].End)
+			}
+		}
+	}
+}
+
+func TestContinuousCPUCollector(t *testing.T) {
+	if err := pprof.StartCPUProfile(new(bytes.Buffer)); err != nil {
+		t.Skipf("CPU profiler is unavailable: %v", err)
+	}
+	pprof.StopCPUProfile()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+
+	var bundles []*bundle.Bundle
+	c := &Collector{
+		ContinuousCPU: &ContinuousCPU{Window: 50 * time.Millisecond},
+		Schedule: &Schedule{
+			Interval:               200 * time.Millisecond,
+			FirstRunTimeBased:      true,
+			CPUProfileDuration:     20 * time.Millisecond,
+			ExecutionTraceDuration: 50 * time.Millisecond,
+			Profiles:               map[string]ProfilePolicy{"trace": {Every: 1}},
+		},
+		StoreBundle: func(meta *autoprof.ArchiveMeta, buf []byte) {
+			b, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+			if err != nil {
+				t.Errorf("bundle.Open; err = %v", err)
+				return
+			}
+			bundles = append(bundles, b)
+		},
+	}
+	err := c.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Run; err = %v", err)
+	}
+	if len(bundles) < 2 {
+		t.Fatalf("stored %d bundles", len(bundles))
+	}
+
+	// The bundles with an execution trace also have the CPU profile that ran
+	// during it, rather than waiting for the continuous profiler. The
+	// exception is a bundle that was in progress when the context ended,
+	// which may have skipped its time-based profiles.
+	for i, b := range bundles[:len(bundles)-1] {
+		var canceled bool
+		for _, skip := range b.Manifest.Skipped {
+			if skip.Reason == autoprof.SkipCanceled && i == len(bundles)-2 {
+				canceled = true
+				continue
+			}
+			t.Errorf("bundle %d; skipped %q: %s", i, skip.Name, skip.Reason)
+		}
+		if canceled {
+			continue
+		}
+		if b.ExecutionTrace == nil || b.CPUProfileDuringTrace == nil {
+			t.Errorf("bundle %d; trace %t, profile during trace %t", i, b.ExecutionTrace != nil, b.CPUProfileDuringTrace != nil)
+		}
+	}
+
+	// When the collection ends, one last bundle holds the windows that
+	// remain. The last of those is the partial window that was in progress,
+	// unless a traced bundle had interrupted it.
+	last := bundles[len(bundles)-1]
+	if last.ExecutionTrace != nil || len(last.CPUProfileWindows) == 0 {
+		t.Fatalf("final bundle; trace %t, %d windows", last.ExecutionTrace != nil, len(last.CPUProfileWindows))
+	}
+	final := last.CPUProfileWindows[len(last.CPUProfileWindows)-1]
+	for _, rec := range last.Manifest.Entries {
+		if rec.Name == final.Path && rec.StopReason != autoprof.StopCanceled && rec.StopReason != autoprof.StopPreempted {
+			t.Errorf("final window; stop reason %q", rec.StopReason)
+		}
+	}
+}
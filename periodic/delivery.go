@@ -0,0 +1,186 @@
+package periodic
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// A DropPolicy chooses which bundle a Collector discards when its delivery
+// queue is full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the bundle that has waited longest, making room
+	// for the new one.
+	DropOldest DropPolicy = iota
+	// DropNewest discards the new bundle, keeping those already in the queue.
+	DropNewest
+)
+
+// Stats counts the bundles that a Collector has handled.
+type Stats struct {
+	// Collected is the number of bundles the Collector has built.
+	Collected uint64
+	// Delivered is the number of bundles that reached Store and StoreBundle.
+	Delivered uint64
+	// Dropped is the number of bundles discarded because the delivery queue
+	// was full, because an earlier delivery failed, or because the Collector
+	// ran out of DrainTimeout before delivering them.
+	Dropped uint64
+	// Failed is the number of bundles that Store did not accept.
+	Failed uint64
+}
+
+type collectorStats struct {
+	collected atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// Stats returns the Collector's counts of bundles. It's safe to call while Run
+// is active.
+func (c *Collector) Stats() Stats {
+	return Stats{
+		Collected: c.stats.collected.Load(),
+		Delivered: c.stats.delivered.Load(),
+		Dropped:   c.stats.dropped.Load(),
+		Failed:    c.stats.failed.Load(),
+	}
+}
+
+const defaultDrainTimeout = 10 * time.Second
+
+// A delivery is a finished bundle on its way to storage.
+type delivery struct {
+	meta *autoprof.ArchiveMeta
+	buf  []byte
+}
+
+// deliver passes the bundle to the Collector's Store and StoreBundle function,
+// retrying as the ErrorPolicy allows.
+func (r *runner) deliver(ctx context.Context, d *delivery) error {
+	if r.c.Store != nil {
+		err := r.put(ctx, d)
+		if err != nil {
+			r.c.stats.failed.Add(1)
+			return err
+		}
+	}
+	if r.c.StoreBundle != nil {
+		r.c.StoreBundle(d.meta, d.buf)
+	}
+	r.c.stats.delivered.Add(1)
+	return nil
+}
+
+// startWorkers begins delivering bundles from the queue in the background. A
+// failed delivery cancels the collection. The returned function stops the
+// workers after they deliver the bundles that remain in the queue, allowing
+// them up to the Collector's DrainTimeout before abandoning the rest.
+func (r *runner) startWorkers(cancel context.CancelFunc) (stop func()) {
+	r.queue = make(chan *delivery, r.c.QueueSize)
+	workers := r.c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// Deliveries outlive the collection's context, so the bundles that are
+	// waiting when the collection ends still reach storage.
+	ctx, abandon := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range r.queue {
+				if ctx.Err() != nil || r.deliveryErr() != nil {
+					r.c.stats.dropped.Add(1)
+					continue
+				}
+				err := r.deliver(ctx, d)
+				if err == nil {
+					r.succeeded()
+				} else if ctx.Err() == nil && r.failed(err) {
+					r.setDeliveryErr(err)
+					cancel()
+				}
+			}
+		}()
+	}
+
+	return func() {
+		close(r.queue)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		drainCtx, cancel := r.drainContext()
+		defer cancel()
+		select {
+		case <-done:
+		case <-drainCtx.Done():
+			abandon()
+			<-done
+		}
+		abandon()
+	}
+}
+
+// enqueue adds the bundle to the delivery queue without blocking, discarding a
+// bundle according to the Collector's DropPolicy if the queue is full.
+func (r *runner) enqueue(d *delivery) {
+	select {
+	case r.queue <- d:
+		return
+	default:
+	}
+
+	if r.c.DropPolicy == DropNewest {
+		r.c.stats.dropped.Add(1)
+		return
+	}
+	select {
+	case <-r.queue:
+		r.c.stats.dropped.Add(1)
+	default:
+		// A worker made room.
+	}
+	// The runner is the only sender, so there's room now.
+	r.queue <- d
+}
+
+// drainContext returns a context for the work that Run does after the
+// collection ends. All of that work shares one DrainTimeout, which starts with
+// the first call.
+func (r *runner) drainContext() (context.Context, context.CancelFunc) {
+	if r.drainDeadline.IsZero() {
+		timeout := r.c.DrainTimeout
+		if timeout <= 0 {
+			timeout = defaultDrainTimeout
+		}
+		r.drainDeadline = time.Now().Add(timeout)
+	}
+	return context.WithDeadline(context.Background(), r.drainDeadline)
+}
+
+func (r *runner) setDeliveryErr(err error) {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	if r.errVal == nil {
+		r.errVal = err
+	}
+}
+
+func (r *runner) deliveryErr() error {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.errVal
+}
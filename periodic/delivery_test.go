@@ -0,0 +1,128 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rhysh/autoprof"
+)
+
+func TestEnqueue(t *testing.T) {
+	for _, tt := range []struct {
+		policy DropPolicy
+		want   []int
+	}{
+		{policy: DropOldest, want: []int{1, 2}},
+		{policy: DropNewest, want: []int{0, 1}},
+	} {
+		c := &Collector{QueueSize: 2, DropPolicy: tt.policy}
+		r := &runner{c: c, queue: make(chan *delivery, c.QueueSize)}
+		for i := 0; i < 3; i++ {
+			r.enqueue(&delivery{meta: testMeta(i)})
+		}
+		close(r.queue)
+		var have []string
+		for d := range r.queue {
+			have = append(have, d.meta.CaptureTime)
+		}
+		if len(have) != len(tt.want) {
+			t.Fatalf("policy %d; queue holds %q", tt.policy, have)
+		}
+		for i, v := range tt.want {
+			if have[i] != testMeta(v).CaptureTime {
+				t.Errorf("policy %d; queue holds %q, expected bundles %d", tt.policy, have, tt.want)
+				break
+			}
+		}
+		if have, want := c.Stats().Dropped, uint64(1); have != want {
+			t.Errorf("policy %d; dropped %d, expected %d", tt.policy, have, want)
+		}
+	}
+}
+
+// slowStore is an autoprof.Store which waits for permission to accept each
+// bundle.
+type slowStore struct {
+	*memStore
+	started chan struct{}
+	release chan error
+}
+
+func (s *slowStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	s.started <- struct{}{}
+	err := <-s.release
+	if err != nil {
+		return err
+	}
+	return s.memStore.Put(ctx, meta, buf)
+}
+
+func TestDeliveryWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &slowStore{memStore: newMemStore(), started: make(chan struct{}), release: make(chan error)}
+	c := &Collector{Store: store, QueueSize: 1}
+	r := &runner{c: c}
+	stop := r.startWorkers(cancel)
+
+	// The first bundle is in progress, and the second waits in the queue
+	// until the third replaces it. None of that waits for storage.
+	r.enqueue(&delivery{meta: testMeta(0)})
+	<-store.started
+	r.enqueue(&delivery{meta: testMeta(1)})
+	r.enqueue(&delivery{meta: testMeta(2)})
+	store.release <- nil
+	<-store.started
+
+	// A failure stops the collection.
+	errFailed := errors.New("storage failed")
+	store.release <- errFailed
+	<-ctx.Done()
+	stop()
+
+	if err := r.deliveryErr(); !errors.Is(err, errFailed) {
+		t.Errorf("deliveryErr; err = %v, expected %v", err, errFailed)
+	}
+	if have, want := c.Stats(), (Stats{Delivered: 1, Dropped: 1, Failed: 1}); have != want {
+		t.Errorf("Stats; %+v != %+v", have, want)
+	}
+	if _, ok := store.bundles[autoprof.BundleKey(testMeta(0))]; !ok {
+		t.Errorf("first bundle was not stored")
+	}
+}
+
+func TestDeliveryDrain(t *testing.T) {
+	store := &slowStore{memStore: newMemStore(), started: make(chan struct{}), release: make(chan error)}
+	c := &Collector{Store: store, QueueSize: 2}
+	r := &runner{c: c}
+	stop := r.startWorkers(func() {})
+
+	// Stopping the collection with bundles still in the queue delivers them.
+	r.enqueue(&delivery{meta: testMeta(0)})
+	<-store.started
+	r.enqueue(&delivery{meta: testMeta(1)})
+	r.enqueue(&delivery{meta: testMeta(2)})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		stop()
+	}()
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			<-store.started
+		}
+		store.release <- nil
+	}
+	<-stopped
+
+	if have, want := c.Stats(), (Stats{Delivered: 3}); have != want {
+		t.Errorf("Stats; %+v != %+v", have, want)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := store.bundles[autoprof.BundleKey(testMeta(i))]; !ok {
+			t.Errorf("bundle %d was not stored", i)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// A DirStore is an autoprof.Store which keeps profile bundles as files in a
+// local directory. Each bundle is in a file named for the CaptureTime of its
+// ArchiveMeta, within nested directories named for its Main, Hostname, and
+// ProcID.
+//
+// After storing each bundle, a DirStore enforces its retention limits by
+// deleting the oldest bundles. A limit of zero disables that check.
+type DirStore struct {
+	// Dir is the directory that holds the bundles.
+	Dir string
+
+	// MaxCount limits the number of bundles in the directory.
+	MaxCount int
+	// MaxBytes limits the total size of the bundles in the directory.
+	MaxBytes int64
+	// MaxAge limits how long to keep each bundle, based on when it was
+	// written to the directory.
+	MaxAge time.Duration
+
+	mu sync.Mutex
+}
+
+var _ autoprof.Store = (*DirStore)(nil)
+
+const (
+	dirStoreExt       = ".zip"
+	dirStoreTmpPrefix = ".tmp-"
+)
+
+// Put writes the bundle to a temporary file, flushes it to disk, and then
+// renames it into place so that readers never see a partial bundle. It rejects
+// metadata that would place the bundle outside of Dir, such as a Main of "..".
+func (s *DirStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, bundle []byte) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	key := autoprof.BundleKey(meta)
+	_, err = autoprof.ParseBundleKey(key)
+	if err != nil {
+		return err
+	}
+	name := s.path(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Dir(name)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(name, bundle)
+	if err != nil {
+		return err
+	}
+	syncDir(dir)
+
+	return s.enforceRetention(time.Now())
+}
+
+// writeFileAtomic creates a file with the provided contents, replacing any
+// existing file of the same name.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), dirStoreTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncDir flushes the directory entry of a newly-renamed file to disk. Not all
+// platforms support this, so it's best-effort.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// List describes the bundles in the directory whose keys begin with prefix.
+func (s *DirStore) List(ctx context.Context, prefix string) ([]*autoprof.StoredBundle, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.walk()
+	if err != nil {
+		return nil, err
+	}
+	var list []*autoprof.StoredBundle
+	for _, f := range files {
+		if strings.HasPrefix(f.sb.Key, prefix) {
+			list = append(list, f.sb)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// Get reads the bundle with the provided key.
+func (s *DirStore) Get(ctx context.Context, key string) ([]byte, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	_, err = autoprof.ParseBundleKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.path(key))
+}
+
+// Delete removes the bundle with the provided key, along with any directories
+// that it leaves empty.
+func (s *DirStore) Delete(ctx context.Context, key string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	_, err = autoprof.ParseBundleKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(s.path(key))
+}
+
+func (s *DirStore) remove(name string) error {
+	err := os.Remove(name)
+	if err != nil {
+		return err
+	}
+	prune(filepath.Dir(name))
+	return nil
+}
+
+// prune cleans up the ProcID, Hostname, and Main directories, starting with
+// dir, when they're empty. Removing a directory that still holds other bundles
+// fails, which ends the cleanup.
+func prune(dir string) {
+	for i := 0; i < 3; i++ {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+type dirStoreFile struct {
+	name    string
+	modTime time.Time
+	sb      *autoprof.StoredBundle
+}
+
+// walk finds all of the bundles in the directory. It ignores files that are
+// not bundles, including temporary files from incomplete writes.
+func (s *DirStore) walk() ([]*dirStoreFile, error) {
+	var files []*dirStoreFile
+	err := filepath.WalkDir(s.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == s.Dir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(name, dirStoreExt) {
+			return nil
+		}
+		sb, ok := s.bundle(name)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		sb.Size = info.Size()
+		files = append(files, &dirStoreFile{name: name, modTime: info.ModTime(), sb: sb})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// enforceRetention removes the oldest bundles until the directory is within
+// all of its limits.
+func (s *DirStore) enforceRetention(now time.Time) error {
+	if s.MaxCount <= 0 && s.MaxBytes <= 0 && s.MaxAge <= 0 {
+		return nil
+	}
+	files, err := s.walk()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if a, b := files[i].modTime, files[j].modTime; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return files[i].sb.Key < files[j].sb.Key
+	})
+
+	var total int64
+	for _, f := range files {
+		total += f.sb.Size
+	}
+	count := len(files)
+	for _, f := range files {
+		expired := s.MaxAge > 0 && now.Sub(f.modTime) > s.MaxAge
+		if !expired && (s.MaxCount <= 0 || count <= s.MaxCount) && (s.MaxBytes <= 0 || total <= s.MaxBytes) {
+			break
+		}
+		err := s.remove(f.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("enforce retention: %w", err)
+		}
+		count--
+		total -= f.sb.Size
+	}
+	return nil
+}
+
+// path returns the name of the file that holds the bundle with the provided
+// key.
+func (s *DirStore) path(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = fileElem(part)
+	}
+	return filepath.Join(s.Dir, filepath.Join(parts...)+dirStoreExt)
+}
+
+// bundle describes the bundle in the named file, reporting whether the file
+// is within the store's layout.
+func (s *DirStore) bundle(name string) (*autoprof.StoredBundle, bool) {
+	rel, err := filepath.Rel(s.Dir, strings.TrimSuffix(name, dirStoreExt))
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 4 || strings.HasPrefix(parts[3], dirStoreTmpPrefix) {
+		return nil, false
+	}
+	for i, part := range parts {
+		elem, ok := keyElem(part)
+		if !ok {
+			return nil, false
+		}
+		parts[i] = elem
+	}
+	sb, err := autoprof.ParseBundleKey(strings.Join(parts, "/"))
+	if err != nil {
+		return nil, false
+	}
+	return sb, true
+}
+
+// fileElem converts an element of a bundle key into a file name. It escapes
+// the ":" characters common in CaptureTime values, which some platforms do not
+// allow in file names, and writes empty elements as "%", which no escaped value
+// can equal.
+func fileElem(part string) string {
+	if part == "" {
+		return "%"
+	}
+	return strings.ReplaceAll(part, ":", "%3A")
+}
+
+// keyElem reverses fileElem.
+func keyElem(name string) (string, bool) {
+	if name == "%" {
+		return "", true
+	}
+	v, err := url.PathUnescape(name)
+	if err != nil {
+		return "", false
+	}
+	return url.PathEscape(v), true
+}
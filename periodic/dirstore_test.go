@@ -0,0 +1,154 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+func testMeta(i int) *autoprof.ArchiveMeta {
+	return &autoprof.ArchiveMeta{
+		Main:        "example.com/cmd/server",
+		Hostname:    "host-1",
+		ProcID:      "0123abcd",
+		CaptureTime: fmt.Sprintf("2021-03-04T05:06:%02d.000Z", i),
+	}
+}
+
+func listKeys(t *testing.T, s autoprof.Store, prefix string) []string {
+	list, err := s.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("List; err = %v", err)
+	}
+	var keys []string
+	for _, sb := range list {
+		keys = append(keys, sb.Key)
+	}
+	return keys
+}
+
+func TestDirStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("round trip", func(t *testing.T) {
+		s := &DirStore{Dir: t.TempDir()}
+		meta := testMeta(1)
+		err := s.Put(ctx, meta, []byte("bundle 1"))
+		if err != nil {
+			t.Fatalf("Put; err = %v", err)
+		}
+		err = s.Put(ctx, &autoprof.ArchiveMeta{ProcID: "other"}, []byte("bundle 2"))
+		if err != nil {
+			t.Fatalf("Put; err = %v", err)
+		}
+		// Leftovers from an interrupted write are not bundles.
+		err = os.WriteFile(filepath.Join(s.Dir, "example.com%2Fcmd%2Fserver", "host-1", "0123abcd", ".tmp-123"), nil, 0o644)
+		if err != nil {
+			t.Fatalf("WriteFile; err = %v", err)
+		}
+
+		key := autoprof.BundleKey(meta)
+		list, err := s.List(ctx, "example.com%2Fcmd%2Fserver/")
+		if err != nil {
+			t.Fatalf("List; err = %v", err)
+		}
+		if len(list) != 1 || list[0].Key != key || list[0].CaptureTime != meta.CaptureTime || list[0].Size != 8 {
+			t.Fatalf("List; found %+v", list)
+		}
+		if have, want := len(listKeys(t, s, "")), 2; have != want {
+			t.Errorf("List; found %d bundles, expected %d", have, want)
+		}
+
+		buf, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get; err = %v", err)
+		}
+		if have, want := string(buf), "bundle 1"; have != want {
+			t.Errorf("Get; %q != %q", have, want)
+		}
+
+		err = s.Delete(ctx, key)
+		if err != nil {
+			t.Fatalf("Delete; err = %v", err)
+		}
+		_, err = s.Get(ctx, key)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get after Delete; err = %v", err)
+		}
+		_, err = s.Get(ctx, "../../etc/passwd")
+		if err == nil {
+			t.Errorf("Get of invalid key; err = nil")
+		}
+
+		// Metadata can't place a bundle outside of the directory.
+		err = s.Put(ctx, &autoprof.ArchiveMeta{Main: "..", Hostname: "host-1", ProcID: "0123abcd"}, []byte("escaped"))
+		if err == nil {
+			t.Errorf("Put of invalid key; err = nil")
+		}
+		_, err = os.Stat(filepath.Join(filepath.Dir(s.Dir), "host-1", "0123abcd", "%"+dirStoreExt))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Put of invalid key; wrote outside of Dir, err = %v", err)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		now := time.Now()
+		put := func(t *testing.T, s *DirStore, i int, age time.Duration) {
+			meta := testMeta(i)
+			err := s.Put(ctx, meta, make([]byte, 100))
+			if err != nil {
+				t.Fatalf("Put; err = %v", err)
+			}
+			mtime := now.Add(-age)
+			err = os.Chtimes(s.path(autoprof.BundleKey(meta)), mtime, mtime)
+			if err != nil {
+				t.Fatalf("Chtimes; err = %v", err)
+			}
+		}
+
+		for _, tt := range []struct {
+			name string
+			s    *DirStore
+			want int
+		}{
+			{name: "unlimited", s: &DirStore{}, want: 5},
+			{name: "count", s: &DirStore{MaxCount: 3}, want: 3},
+			{name: "bytes", s: &DirStore{MaxBytes: 250}, want: 2},
+			{name: "age", s: &DirStore{MaxAge: 210 * time.Minute}, want: 3},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				s := tt.s
+				s.Dir = t.TempDir()
+				// Write bundles from oldest to newest, with the final Put
+				// applying the limits.
+				for i := 0; i < 4; i++ {
+					put(t, s, i, time.Duration(5-i)*time.Hour)
+				}
+				put(t, s, 4, 0)
+				err := s.enforceRetention(now)
+				if err != nil {
+					t.Fatalf("enforceRetention; err = %v", err)
+				}
+
+				keys := listKeys(t, s, "")
+				if have := len(keys); have != tt.want {
+					t.Fatalf("found %d bundles, expected %d", have, tt.want)
+				}
+				// The newest bundles remain.
+				if have, want := keys[len(keys)-1], autoprof.BundleKey(testMeta(4)); have != want {
+					t.Errorf("newest bundle; %q != %q", have, want)
+				}
+				if have, want := keys[0], autoprof.BundleKey(testMeta(5-tt.want)); have != want {
+					t.Errorf("oldest bundle; %q != %q", have, want)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package periodic
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// An ErrorPolicy decides how a Collector responds to failures. The zero value
+// makes Run return the first error, without retrying.
+type ErrorPolicy struct {
+	// Retries is the number of additional attempts to store each bundle
+	// after Store returns an error.
+	Retries int
+	// RetryBackoff is the delay before the first retry, which doubles after
+	// each additional failed attempt. If zero, it defaults to one second.
+	RetryBackoff time.Duration
+
+	// MaxConsecutiveFailures is the number of bundles in a row that the
+	// Collector may fail to build or store before Run returns the error.
+	// Zero has the same effect as one. When negative, Run continues
+	// collecting regardless of failures.
+	MaxConsecutiveFailures int
+}
+
+// put stores the bundle, retrying with backoff as the ErrorPolicy allows.
+func (r *runner) put(ctx context.Context, d *delivery) error {
+	policy := r.c.ErrorPolicy
+	backoff := policy.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultMinBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := r.c.Store.Put(ctx, d.meta, d.buf)
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("store bundle: %w", err)
+		if attempt >= policy.Retries || ctx.Err() != nil {
+			return err
+		}
+		r.reportErr(err)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		backoff *= 2
+		if backoff > defaultMaxBackoff {
+			backoff = defaultMaxBackoff
+		}
+	}
+}
+
+// failed reports the failure to build or store a bundle, and returns whether
+// the Collector should stop.
+func (r *runner) failed(err error) bool {
+	r.reportErr(err)
+
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	r.failures++
+	max := r.c.ErrorPolicy.MaxConsecutiveFailures
+	if max < 0 {
+		return false
+	}
+	if max == 0 {
+		max = 1
+	}
+	return r.failures >= max
+}
+
+// succeeded notes that a bundle reached storage.
+func (r *runner) succeeded() {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	r.failures = 0
+}
+
+func (r *runner) reportErr(err error) {
+	if r.c.OnError != nil {
+		r.c.OnError(err)
+	}
+}
@@ -0,0 +1,98 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// flakyStore is an autoprof.Store which fails a set number of times before
+// accepting bundles.
+type flakyStore struct {
+	*memStore
+	failures int
+}
+
+func (s *flakyStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	if s.failures > 0 {
+		s.failures--
+		return errUnavailable
+	}
+	return s.memStore.Put(ctx, meta, buf)
+}
+
+func TestErrorPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("retry", func(t *testing.T) {
+		for _, tt := range []struct {
+			retries  int
+			failures int
+			ok       bool
+		}{
+			{retries: 0, failures: 0, ok: true},
+			{retries: 0, failures: 1, ok: false},
+			{retries: 2, failures: 2, ok: true},
+			{retries: 2, failures: 3, ok: false},
+		} {
+			var reported int
+			store := &flakyStore{memStore: newMemStore(), failures: tt.failures}
+			c := &Collector{
+				Store:       store,
+				ErrorPolicy: ErrorPolicy{Retries: tt.retries, RetryBackoff: time.Millisecond},
+				OnError:     func(err error) { reported++ },
+			}
+			r := &runner{c: c}
+			err := r.deliver(ctx, &delivery{meta: testMeta(0)})
+			if have := err == nil; have != tt.ok {
+				t.Errorf("retries=%d failures=%d; err = %v", tt.retries, tt.failures, err)
+			}
+			if err != nil && !errors.Is(err, errUnavailable) {
+				t.Errorf("retries=%d failures=%d; err = %v, expected %v", tt.retries, tt.failures, err, errUnavailable)
+			}
+			// The caller reports the final failure.
+			if have, want := reported, tt.failures; tt.ok && have != want {
+				t.Errorf("retries=%d failures=%d; reported %d errors, expected %d", tt.retries, tt.failures, have, want)
+			}
+		}
+	})
+
+	t.Run("consecutive failures", func(t *testing.T) {
+		for _, tt := range []struct {
+			max  int
+			stop int // the failure that stops the collector, or 0 for never
+		}{
+			{max: 0, stop: 1},
+			{max: 1, stop: 1},
+			{max: 3, stop: 3},
+			{max: -1, stop: 0},
+		} {
+			var reported int
+			c := &Collector{
+				ErrorPolicy: ErrorPolicy{MaxConsecutiveFailures: tt.max},
+				OnError:     func(err error) { reported++ },
+			}
+			r := &runner{c: c}
+
+			// Success resets the count.
+			r.failed(errUnavailable)
+			r.succeeded()
+
+			stop := 0
+			for i := 1; i <= 5 && stop == 0; i++ {
+				if r.failed(errUnavailable) {
+					stop = i
+				}
+			}
+			if stop != tt.stop {
+				t.Errorf("MaxConsecutiveFailures=%d; stopped on failure %d, expected %d", tt.max, stop, tt.stop)
+			}
+			if have, want := reported, 1+stop; stop != 0 && have != want {
+				t.Errorf("MaxConsecutiveFailures=%d; reported %d errors, expected %d", tt.max, have, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// A FinalBundle captures one last profile bundle as the process exits, and
+// writes it to a local directory. It includes the stack of every goroutine
+// (the "goroutine" profile with debug=2), the heap profile, expvar values,
+// and runtime/metrics, but no CPU profile or execution trace, so it can finish
+// quickly.
+//
+// Set the Final field of Collector to capture a bundle when the context
+// passed to Collector.Run ends, or call CapturePanic in a deferred function
+// to capture a bundle when the program panics.
+type FinalBundle struct {
+	// Dir is the directory that holds the bundles, in the same layout as a
+	// DirStore. It must be set: with an empty Dir, Capture returns an error
+	// rather than writing into the working directory.
+	Dir string
+
+	// Timeout limits how long the capture may delay the process's exit. If
+	// zero, it defaults to two seconds.
+	Timeout time.Duration
+}
+
+const defaultFinalTimeout = 2 * time.Second
+
+var (
+	errFinalTimeout = errors.New("final bundle: timed out")
+	errFinalNoDir   = errors.New("final bundle: no Dir specified")
+)
+
+// Capture collects a bundle and writes it to Dir, returning within Timeout.
+// The reason becomes the name of the bundle's trigger, as recorded in its
+// metadata, such as "shutdown".
+func (f *FinalBundle) Capture(reason string) error {
+	return f.capture(reason, nil)
+}
+
+// CapturePanic captures a bundle when the program is panicking, and then
+// continues the panic. It must be called directly by a deferred function, as
+// in
+//
+//	defer final.CapturePanic()
+//
+// near the start of the main function or of any goroutine that might panic.
+func (f *FinalBundle) CapturePanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	panicSource := &autoprof.DataSource{WriteTo: func(ctx context.Context, w io.Writer) error {
+		_, err := fmt.Fprintf(w, "panic: %v\n", v)
+		return err
+	}}
+	f.capture("panic", panicSource)
+	panic(v)
+}
+
+// capture collects a bundle for the provided reason, including the extra data
+// source if it's set.
+func (f *FinalBundle) capture(reason string, extra *autoprof.DataSource) error {
+	if f.Dir == "" {
+		return errFinalNoDir
+	}
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = defaultFinalTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	meta := autoprof.CurrentArchiveMeta()
+	meta.Trigger = &autoprof.ArchiveTrigger{Name: reason}
+	opts := &autoprof.ArchiveOptions{
+		IncludeProfiles: []string{"heap", "goroutine", "runtime/metrics"},
+		ProfileDebug:    map[string]int{"goroutine": 2},
+		RecordErrors:    true,
+	}
+	if extra != nil {
+		opts.CustomDataSources = map[string]*autoprof.DataSource{reason: extra}
+	}
+
+	// Not every part of the collection watches the context, so enforce the
+	// time limit here. The store writes each bundle to a temporary file and
+	// then renames it, so a bundle that's abandoned partway won't appear.
+	done := make(chan error, 1)
+	go func() {
+		var buf bytes.Buffer
+		err := autoprof.NewZipCollector(&buf, meta, opts).Run(ctx)
+		if err == nil {
+			store := &DirStore{Dir: f.Dir}
+			err = store.Put(ctx, meta, buf.Bytes())
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("final bundle: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return errFinalTimeout
+	}
+}
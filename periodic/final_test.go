@@ -0,0 +1,174 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+// readFinal returns the only bundle in the directory.
+func readFinal(t *testing.T, dir string) *bundle.Bundle {
+	t.Helper()
+	s := &DirStore{Dir: dir}
+	list, err := s.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("List; err = %v", err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("List; found %d bundles, expected 1", len(list))
+	}
+	buf, err := s.Get(context.Background(), list[0].Key)
+	if err != nil {
+		t.Fatalf("Get; err = %v", err)
+	}
+	b, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("bundle.Open; err = %v", err)
+	}
+	return b
+}
+
+func TestFinalBundle(t *testing.T) {
+	t.Run("no dir", func(t *testing.T) {
+		f := &FinalBundle{}
+		err := f.Capture("shutdown")
+		if !errors.Is(err, errFinalNoDir) {
+			t.Errorf("Capture; err = %v, expected %v", err, errFinalNoDir)
+		}
+	})
+
+	t.Run("capture", func(t *testing.T) {
+		f := &FinalBundle{Dir: t.TempDir()}
+		err := f.Capture("shutdown")
+		if err != nil {
+			t.Fatalf("Capture; err = %v", err)
+		}
+
+		b := readFinal(t, f.Dir)
+		if b.Meta.Trigger == nil || b.Meta.Trigger.Name != "shutdown" {
+			t.Errorf("meta trigger; %#v", b.Meta.Trigger)
+		}
+		var names []string
+		for _, e := range b.Profiles {
+			names = append(names, e.Name)
+			if e.Name != "goroutine" {
+				continue
+			}
+			buf, err := e.ReadAll()
+			if err != nil {
+				t.Fatalf("ReadAll; err = %v", err)
+			}
+			if !bytes.Contains(buf, []byte("[running]")) {
+				t.Errorf("goroutine profile is not in debug=2 format")
+			}
+		}
+		if have, want := len(names), 2; have != want {
+			t.Errorf("profiles; %q has %d elements, expected %d", names, have, want)
+		}
+		if b.Expvar == nil || b.Metrics == nil {
+			t.Errorf("bundle is missing expvar or runtime/metrics")
+		}
+		if b.CPUProfile != nil || b.ExecutionTrace != nil {
+			t.Errorf("bundle includes a time-based profile")
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		f := &FinalBundle{Dir: t.TempDir()}
+		func() {
+			defer func() {
+				if v := recover(); v != "boom" {
+					t.Errorf("recover; %v != %q", v, "boom")
+				}
+			}()
+			defer f.CapturePanic()
+			panic("boom")
+		}()
+
+		b := readFinal(t, f.Dir)
+		if b.Meta.Trigger == nil || b.Meta.Trigger.Name != "panic" {
+			t.Errorf("meta trigger; %#v", b.Meta.Trigger)
+		}
+		if len(b.Custom) != 1 {
+			t.Fatalf("custom; found %d entries, expected 1", len(b.Custom))
+		}
+		buf, err := b.Custom[0].ReadAll()
+		if err != nil {
+			t.Fatalf("ReadAll; err = %v", err)
+		}
+		if have, want := string(buf), "panic: boom\n"; have != want {
+			t.Errorf("custom/panic; %q != %q", have, want)
+		}
+	})
+
+	t.Run("collector", func(t *testing.T) {
+		f := &FinalBundle{Dir: t.TempDir()}
+		c := &Collector{
+			Store: newMemStore(),
+			Final: f,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := c.Run(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Run; err = %v, expected %v", err, context.DeadlineExceeded)
+		}
+
+		b := readFinal(t, f.Dir)
+		if b.Meta.Trigger == nil || b.Meta.Trigger.Name != "shutdown" {
+			t.Errorf("meta trigger; %#v", b.Meta.Trigger)
+		}
+	})
+
+	t.Run("before drain", func(t *testing.T) {
+		// The final bundle doesn't wait for a delivery that's stuck until
+		// the DrainTimeout.
+		f := &FinalBundle{Dir: t.TempDir()}
+		store := &drainStore{memStore: newMemStore(), started: make(chan struct{}, 1), dir: f.Dir}
+		c := &Collector{
+			Store:        store,
+			Final:        f,
+			QueueSize:    1,
+			DrainTimeout: 200 * time.Millisecond,
+			Schedule:     &Schedule{Interval: time.Millisecond},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-store.started
+			cancel()
+		}()
+		err := c.Run(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run; err = %v, expected %v", err, context.Canceled)
+		}
+		if store.finalCount != 1 {
+			t.Errorf("final bundles when the stuck delivery ended; %d != 1", store.finalCount)
+		}
+	})
+}
+
+// drainStore is an autoprof.Store whose Put waits until its context ends, and
+// then counts the bundles in a FinalBundle's directory.
+type drainStore struct {
+	*memStore
+	started    chan struct{}
+	dir        string
+	finalCount int
+}
+
+func (s *drainStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	list, _ := (&DirStore{Dir: s.dir}).List(context.Background(), "")
+	s.finalCount = len(list)
+	return ctx.Err()
+}
@@ -0,0 +1,193 @@
+package periodic
+
+import (
+	"math"
+	"math/rand"
+	"runtime/metrics"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// An OverheadBudget limits the cost of building bundles. After each bundle,
+// the Collector compares the process's CPU time and allocations while building
+// it against the rate before it started, and attributes the difference to the
+// Collector. When the recent cost is over budget, it stretches its Schedule by
+// waiting longer between bundles, collecting shorter CPU profiles, and
+// including fewer execution traces. When the cost is under budget, it returns
+// toward the Schedule as configured.
+type OverheadBudget struct {
+	// CPU is the largest fraction of the process's CPU time to spend building
+	// bundles, such as 0.01 for 1%. Zero means no limit. The measurement
+	// depends on the "/cpu/classes/" metrics of runtime/metrics, which are
+	// available in Go 1.20 and newer.
+	CPU float64
+	// Alloc is the largest fraction of the process's allocated bytes to
+	// spend building bundles, including the bundles themselves. Zero means
+	// no limit.
+	Alloc float64
+
+	// MaxScale limits how far the Collector may stretch its Schedule. If
+	// zero, it defaults to 30.
+	MaxScale float64
+	// MinCPUProfileDuration limits how short the Collector may make each CPU
+	// profile. If zero, it defaults to one second.
+	MinCPUProfileDuration time.Duration
+}
+
+const (
+	defaultOverheadMaxScale      = 30
+	defaultMinCPUProfileDuration = 1 * time.Second
+	overheadSmoothing            = 0.3
+	overheadMaxAdjustment        = 2
+	costMetricCPUTotal           = "/cpu/classes/total:cpu-seconds"
+	costMetricCPUIdle            = "/cpu/classes/idle:cpu-seconds"
+	costMetricHeapAllocs         = "/gc/heap/allocs:bytes"
+)
+
+// A costSample holds the process's cumulative resource use at one point in
+// time.
+type costSample struct {
+	time time.Time
+	// cpu is the CPU time that the process has used, in seconds. It's valid
+	// only when cpuOK is set.
+	cpu   float64
+	cpuOK bool
+	alloc uint64
+}
+
+func readCostSample() costSample {
+	samples := []metrics.Sample{
+		{Name: costMetricCPUTotal},
+		{Name: costMetricCPUIdle},
+		{Name: costMetricHeapAllocs},
+	}
+	metrics.Read(samples)
+
+	cs := costSample{time: time.Now()}
+	if samples[0].Value.Kind() == metrics.KindFloat64 && samples[1].Value.Kind() == metrics.KindFloat64 {
+		cs.cpu = samples[0].Value.Float64() - samples[1].Value.Float64()
+		cs.cpuOK = true
+	}
+	if samples[2].Value.Kind() == metrics.KindUint64 {
+		cs.alloc = samples[2].Value.Uint64()
+	}
+	return cs
+}
+
+// An overheadTracker measures the cost of each bundle and decides how far to
+// stretch the schedule.
+type overheadTracker struct {
+	budget OverheadBudget
+
+	// last is the sample from the end of the previous bundle.
+	last costSample
+	// scale is the factor by which to stretch the schedule.
+	scale float64
+
+	measured           bool
+	cpuFrac, allocFrac float64
+	prevCPU            float64
+	prevAlloc          uint64
+	prevBundle         int64
+}
+
+func newOverheadTracker(budget OverheadBudget, now costSample) *overheadTracker {
+	if budget.MaxScale <= 0 {
+		budget.MaxScale = defaultOverheadMaxScale
+	}
+	if budget.MinCPUProfileDuration <= 0 {
+		budget.MinCPUProfileDuration = defaultMinCPUProfileDuration
+	}
+	return &overheadTracker{budget: budget, last: now, scale: 1}
+}
+
+// observe measures the cost of the bundle built from start to end, and updates
+// the scale of the schedule.
+func (t *overheadTracker) observe(start, end costSample, bundleBytes int64) {
+	defer func() { t.last = end }()
+
+	before := start.time.Sub(t.last.time).Seconds()
+	during := end.time.Sub(start.time).Seconds()
+	if before <= 0 || during < 0 {
+		return
+	}
+
+	// Attribute to the bundle any use beyond the rate from before it
+	// started.
+	var cpuCost, cpuFrac float64
+	if start.cpuOK && end.cpuOK && t.last.cpuOK {
+		rate := (start.cpu - t.last.cpu) / before
+		cpuCost = math.Max(0, (end.cpu-start.cpu)-rate*during)
+		if total := end.cpu - t.last.cpu; total > 0 {
+			cpuFrac = math.Min(1, cpuCost/total)
+		}
+	}
+	rate := float64(start.alloc-t.last.alloc) / before
+	allocCost := math.Max(0, float64(end.alloc-start.alloc)-rate*during)
+	allocCost = math.Max(allocCost, float64(bundleBytes))
+	var allocFrac float64
+	if total := float64(end.alloc - t.last.alloc); total > 0 {
+		allocFrac = math.Min(1, allocCost/total)
+	}
+
+	t.prevCPU = cpuCost
+	t.prevAlloc = uint64(allocCost)
+	t.prevBundle = bundleBytes
+	if !t.measured {
+		t.cpuFrac, t.allocFrac = cpuFrac, allocFrac
+		t.measured = true
+	} else {
+		t.cpuFrac += overheadSmoothing * (cpuFrac - t.cpuFrac)
+		t.allocFrac += overheadSmoothing * (allocFrac - t.allocFrac)
+	}
+
+	// The cost of each bundle is roughly constant, so the overhead is
+	// inversely proportional to the scale.
+	var ratio float64
+	if t.budget.CPU > 0 {
+		ratio = math.Max(ratio, t.cpuFrac/t.budget.CPU)
+	}
+	if t.budget.Alloc > 0 {
+		ratio = math.Max(ratio, t.allocFrac/t.budget.Alloc)
+	}
+	if ratio == 0 {
+		return
+	}
+	ratio = math.Max(1/float64(overheadMaxAdjustment), math.Min(overheadMaxAdjustment, ratio))
+	t.scale = math.Max(1, math.Min(t.budget.MaxScale, t.scale*ratio))
+}
+
+// adjust stretches the bundle's options according to the current scale.
+func (t *overheadTracker) adjust(opts *autoprof.ArchiveOptions, rng *rand.Rand) {
+	if t.scale <= 1 {
+		return
+	}
+	if d := opts.CPUProfileDuration; d > 0 {
+		short := time.Duration(float64(d) / t.scale)
+		if short < t.budget.MinCPUProfileDuration {
+			short = t.budget.MinCPUProfileDuration
+		}
+		if short < d {
+			opts.CPUProfileDuration = short
+		}
+	}
+	// Keep each scheduled execution trace with probability 1/scale.
+	if opts.ExecutionTraceDuration > 0 && rng.Float64()*t.scale >= 1 {
+		opts.ExecutionTraceDuration = 0
+	}
+}
+
+// report describes the recent overhead, for the metadata of the next bundle.
+func (t *overheadTracker) report() *autoprof.Overhead {
+	return &autoprof.Overhead{
+		CPUBudget:       t.budget.CPU,
+		AllocBudget:     t.budget.Alloc,
+		CPUFraction:     t.cpuFrac,
+		AllocFraction:   t.allocFrac,
+		PrevCPUSeconds:  t.prevCPU,
+		PrevAllocBytes:  t.prevAlloc,
+		PrevBundleBytes: t.prevBundle,
+		Scale:           t.scale,
+	}
+}
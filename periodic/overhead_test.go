@@ -0,0 +1,58 @@
+package periodic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+func TestOverheadTracker(t *testing.T) {
+	start := time.Now()
+	sample := func(sec float64, cpu float64, alloc uint64) costSample {
+		return costSample{
+			time:  start.Add(time.Duration(sec * float64(time.Second))),
+			cpu:   cpu,
+			cpuOK: true,
+			alloc: alloc,
+		}
+	}
+
+	tr := newOverheadTracker(OverheadBudget{CPU: 0.01}, sample(0, 0, 0))
+
+	// The process uses one CPU-second per second, and the collection takes
+	// an extra 5 CPU-seconds over 10 seconds: 5/115 is over budget.
+	tr.observe(sample(100, 100, 1e6), sample(110, 115, 1.1e6), 1e4)
+	if have, want := tr.prevCPU, 5.0; have < want-1e-9 || have > want+1e-9 {
+		t.Errorf("prevCPU; %f != %f", have, want)
+	}
+	if tr.scale <= 1 {
+		t.Errorf("scale %f is not over 1 after exceeding budget", tr.scale)
+	}
+	high := tr.scale
+
+	opts := &autoprof.ArchiveOptions{CPUProfileDuration: 5 * time.Second, ExecutionTraceDuration: time.Second}
+	tr.adjust(opts, rand.New(rand.NewSource(1)))
+	if opts.CPUProfileDuration >= 5*time.Second || opts.CPUProfileDuration < time.Second {
+		t.Errorf("CPUProfileDuration %s not shortened within limits", opts.CPUProfileDuration)
+	}
+
+	meta := tr.report()
+	if meta.Scale != high || meta.CPUBudget != 0.01 || meta.PrevBundleBytes != 1e4 {
+		t.Errorf("report; %+v", meta)
+	}
+
+	// Cheap collections bring the scale back down to 1.
+	now := 110.0
+	for i := 0; i < 20; i++ {
+		tr.observe(sample(now+100, now+100, 2e6), sample(now+110, now+110, 2e6), 1e4)
+		now += 110
+	}
+	if tr.scale != 1 {
+		t.Errorf("scale %f did not return to 1 under budget", tr.scale)
+	}
+	if tr.cpuFrac > 0.001 {
+		t.Errorf("cpuFrac %f did not decay", tr.cpuFrac)
+	}
+}
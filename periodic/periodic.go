@@ -3,32 +3,92 @@ package periodic
 import (
 	"context"
 	crand "crypto/rand"
-	"fmt"
 	"io"
 	"math"
 	"math/big"
 	"math/rand"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/rhysh/autoprof"
 )
 
-const (
-	// defaultProfileInterval adjusts the upper limit on the interval between
-	// profiles: from the end of one to the start of the next. The package
-	// applies jitter to the time between each profile, which will result in
-	// slightly more frequent samples on average.
-	defaultProfileInterval = 2 * time.Minute
-)
+// profilerWait limits how long a scheduled collection will wait for another
+// user of the CPU profiler or execution tracer to finish.
+const profilerWait = 1 * time.Minute
 
 // A Collector periodically builds a profile bundle for the process.
 type Collector struct {
+	// Store receives each profile bundle. The ErrorPolicy decides whether
+	// to retry a failure to store a bundle, and whether to continue the
+	// collection after it; by default, the first failure ends the
+	// collection. See DirStore for an implementation that writes to a local
+	// directory.
+	Store autoprof.Store
+
+	// StoreBundle, if set, also receives each profile bundle, after Store.
 	StoreBundle func(meta *autoprof.ArchiveMeta, buf []byte)
+
+	// Recent, if set, holds onto the most recent bundles in memory as soon as
+	// they're complete, before their delivery to Store. An autoprof.Handler
+	// with the same MemoryStore can serve them without delay.
+	Recent *autoprof.MemoryStore
+
+	// Schedule controls when to build each bundle and what to include in it.
+	// If nil, the Collector uses DefaultSchedule.
+	Schedule *Schedule
+
+	// Overhead, if set, limits the cost of building bundles by stretching the
+	// Schedule when the measured cost exceeds the budget.
+	Overhead *OverheadBudget
+
+	// ContinuousCPU, if set, runs CPU profiles back-to-back in the
+	// background, and includes them in the bundles in place of each bundle's
+	// own CPU profile.
+	ContinuousCPU *ContinuousCPU
+
+	// Final, if set, captures one last bundle when the context passed to Run
+	// ends, such as during a graceful shutdown. It writes the bundle to its
+	// own directory rather than to Store. Run captures it before delivering
+	// the queued bundles, so only the FinalBundle's Timeout delays it.
+	Final *FinalBundle
+
+	// DeltaProfiles requests that each bundle include the change in the
+	// cumulative runtime/pprof profiles ("heap", "allocs", "block", and
+	// "mutex") since the previous bundle. See the DeltaProfiles field of
+	// autoprof.ArchiveOptions.
+	DeltaProfiles bool
+
+	// QueueSize is the number of finished bundles that may wait for delivery
+	// to Store and StoreBundle. When it's zero, the Collector delivers each
+	// bundle before starting to wait for the next one, so slow storage delays
+	// later bundles. Otherwise, Workers goroutines deliver the bundles in the
+	// background, and DropPolicy decides what happens when the queue is full.
+	QueueSize int
+	// Workers is the number of goroutines delivering queued bundles. If zero,
+	// it defaults to one.
+	Workers int
+	// DropPolicy chooses which bundle to discard when the queue is full.
+	DropPolicy DropPolicy
+	// DrainTimeout limits how long Run continues after its context ends,
+	// storing the last bundle of CPU profile windows when ContinuousCPU is
+	// set and delivering the queued bundles. Both share the one limit. If
+	// zero, it defaults to ten seconds.
+	DrainTimeout time.Duration
+
+	// ErrorPolicy decides how the Collector responds when it fails to build
+	// or store a bundle. By default, Run returns the first such error.
+	ErrorPolicy ErrorPolicy
+	// OnError, if set, receives each error from building or storing a
+	// bundle, including failed attempts that the Collector will retry. When
+	// Workers is more than one, it may be called concurrently.
+	OnError func(err error)
+
+	stats collectorStats
 }
 
 // Run periodically builds a profile bundle for the processes and passes it to
-// the provided StoreBundle function.
+// the provided Store and StoreBundle function.
 func (c *Collector) Run(ctx context.Context) error {
 	seed, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
@@ -37,12 +97,49 @@ func (c *Collector) Run(ctx context.Context) error {
 	}
 
 	r := &runner{
-		c:   c,
-		rng: rand.New(rand.NewSource(seed.Int64())),
+		c:        c,
+		rng:      rand.New(rand.NewSource(seed.Int64())),
+		schedule: c.Schedule.withDefaults(),
+	}
+	if c.Overhead != nil {
+		r.overhead = newOverheadTracker(*c.Overhead, readCostSample())
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.QueueSize > 0 {
+		stop := r.startWorkers(cancel)
+		defer stop()
+	}
+	if c.ContinuousCPU != nil {
+		wait := r.startContinuous(ctx)
+		defer r.flushWindows()
+		defer wait()
+		defer cancel()
+	}
+	if c.Final != nil {
+		// Capture the final bundle first, before the rest of the shutdown
+		// work can delay it.
+		defer func() {
+			if parent.Err() == nil {
+				// The collection failed; the process isn't necessarily
+				// shutting down.
+				return
+			}
+			err := c.Final.Capture("shutdown")
+			if err != nil {
+				r.reportErr(err)
+			}
+		}()
 	}
 
 	for i := 0; ; i++ {
 		r.delay(ctx, i)
+		err = r.deliveryErr()
+		if err != nil {
+			return err
+		}
 		err = ctx.Err()
 		if err != nil {
 			// fatal error, return immediately
@@ -51,8 +148,21 @@ func (c *Collector) Run(ctx context.Context) error {
 
 		opts := r.options(i)
 		err := r.store(ctx, opts)
+		if derr := r.deliveryErr(); derr != nil {
+			// A failed delivery in the background ended the collection.
+			return derr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			return err
+			if r.failed(err) {
+				return err
+			}
+			continue
+		}
+		if r.queue == nil {
+			r.succeeded()
 		}
 	}
 }
@@ -60,48 +170,113 @@ func (c *Collector) Run(ctx context.Context) error {
 type runner struct {
 	c *Collector
 
-	rng           *rand.Rand
-	nextExecTrace int
+	rng      *rand.Rand
+	schedule *Schedule
+	// profiles tracks when each kind of data with a ProfilePolicy last
+	// appeared in a bundle.
+	profiles map[string]*profileState
+	// overhead measures the cost of each bundle, when the Collector has an
+	// OverheadBudget.
+	overhead *overheadTracker
+	// windows holds the CPU profiles from the continuous profiler, when the
+	// Collector has ContinuousCPU set.
+	windows *windowBuffer
+
+	// deltaBase is the snapshot of the cumulative profiles at the end of the
+	// previous bundle.
+	deltaBase *autoprof.ProfileSnapshot
+
+	// queue holds the bundles waiting for delivery, when the Collector
+	// delivers them in the background.
+	queue chan *delivery
+	// drainDeadline is when the work after the collection ends must stop,
+	// once it has started.
+	drainDeadline time.Time
+
+	errMu  sync.Mutex
+	errVal error
+	// failures counts consecutive failures to build or store a bundle.
+	failures int
 }
 
 func (r *runner) options(i int) *autoprof.ArchiveOptions {
-	var opts autoprof.ArchiveOptions
+	opts := autoprof.DefaultArchiveOptions()
 
-	opts.CPUProfileDuration = 5 * time.Second
-	opts.CPUProfileByteTarget = 1e6
+	// Yield the profilers to interactive requests, and wait a bounded time
+	// for them to finish.
+	opts.Priority = autoprof.PriorityBackground
+	opts.ProfilerWait = profilerWait
+
+	s := r.schedule
+	opts.CPUProfileDuration = 0
+	if s.CPUProfileDuration > 0 {
+		opts.CPUProfileDuration = s.CPUProfileDuration
+	}
+	opts.CPUProfileByteTarget = s.CPUProfileByteTarget
+	if s.ExecutionTraceDuration > 0 {
+		opts.ExecutionTraceDuration = s.ExecutionTraceDuration
+	}
+	opts.ExecutionTraceByteTarget = s.ExecutionTraceByteTarget
 
-	// Execution traces are often quite large, and are harder to analyze in
-	// aggregate in the same ways that pprof-formatted profiles can. Store fewer
-	// of them.
-	if r.nextExecTrace == i {
-		const execTraceMaxPeriod = 100
-		r.nextExecTrace = i + 1 + r.rng.Intn(execTraceMaxPeriod)
-		opts.ExecutionTraceDuration = 1 * time.Second
+	for _, name := range r.excludedProfiles(s, i, time.Now()) {
+		switch name {
+		case "profile":
+			opts.CPUProfileDuration = 0
+		case "trace":
+			opts.ExecutionTraceDuration = 0
+		default:
+			opts.ExcludeProfiles = append(opts.ExcludeProfiles, name)
+		}
 	}
-	opts.ExecutionTraceByteTarget = 1e7
+
+	opts.DeltaProfiles = r.c.DeltaProfiles
+	opts.DeltaBase = r.deltaBase
 
 	// Don't include variable-duration profiles on the first run; we'd like a
 	// good chance of getting at least a little data from short-lived
 	// processes.
-	if i == 0 {
+	if i == 0 && !s.FirstRunTimeBased {
 		opts.CPUProfileDuration = 0
 		opts.ExecutionTraceDuration = 0
 	}
 
-	return &opts
+	if r.overhead != nil {
+		r.overhead.adjust(opts, r.rng)
+	}
+
+	if r.windows != nil {
+		// The continuous profiler has the CPU profiler, and its windows take
+		// the place of the bundle's own CPU profile. But a bundle with an
+		// execution trace keeps its CPU profile, which runs during the trace
+		// so that the trace includes CPU samples. The continuous profiler
+		// yields to it.
+		if opts.ExecutionTraceDuration <= 0 {
+			opts.CPUProfileDuration = 0
+		}
+		opts.CPUProfileWindows = r.windows.take()
+	}
+
+	return opts
 }
 
 func (r *runner) delay(ctx context.Context, i int) {
-	max := int64(defaultProfileInterval)
+	max := int64(r.schedule.Interval)
+	if r.overhead != nil {
+		max = int64(float64(max) * r.overhead.scale)
+	}
 
-	// shorten the delay by up to 100% on the first run, and by up to 20% on
-	// subsequent runs
-	maxTrim := max
-	if i > 0 {
-		maxTrim = max / 5
+	// shorten the delay by a random fraction of the interval, by default up
+	// to 100% on the first run and up to 20% on subsequent runs
+	jitter := r.schedule.Jitter
+	if i == 0 {
+		jitter = r.schedule.FirstJitter
 	}
+	maxTrim := int64(float64(max) * math.Min(jitter, 1))
 
-	trim := r.rng.Int63n(maxTrim)
+	var trim int64
+	if maxTrim > 0 {
+		trim = r.rng.Int63n(maxTrim)
+	}
 	t := time.NewTimer(time.Duration(max - trim))
 	defer t.Stop()
 
@@ -113,6 +288,11 @@ func (r *runner) delay(ctx context.Context, i int) {
 
 func (r *runner) store(ctx context.Context, opts *autoprof.ArchiveOptions) error {
 	meta := autoprof.CurrentArchiveMeta()
+	var start costSample
+	if r.overhead != nil {
+		meta.Overhead = r.overhead.report()
+		start = readCostSample()
+	}
 
 	// Some profile types are sensitive to latency when writing out their data.
 	// The execution tracer is one such profile type, which results in
@@ -120,10 +300,12 @@ func (r *runner) store(ctx context.Context, opts *autoprof.ArchiveOptions) error
 	// some applications. Use a buffer type that does not introduce large
 	// latency spikes.
 	llb := &linkedListBuffer{}
-	err := autoprof.NewZipCollector(llb, meta, opts).Run(ctx)
+	c := autoprof.NewZipCollector(llb, meta, opts)
+	err := c.Run(ctx)
 	if err != nil {
 		return err
 	}
+	r.deltaBase = c.DeltaSnapshot()
 
 	// Now that the latency-sensitive portion is complete, convert the buffer
 	// into a format convenient for storage.
@@ -131,16 +313,25 @@ func (r *runner) store(ctx context.Context, opts *autoprof.ArchiveOptions) error
 	if err != nil {
 		return err
 	}
+	r.c.stats.collected.Add(1)
+	if r.overhead != nil {
+		r.overhead.observe(start, readCostSample(), int64(len(buf)))
+	}
+	if r.c.Recent != nil {
+		r.c.Recent.Put(ctx, meta, buf)
+	}
 
-	r.c.StoreBundle(meta, buf)
-
-	return nil
+	d := &delivery{meta: meta, buf: buf}
+	if r.queue != nil {
+		r.enqueue(d)
+		return nil
+	}
+	return r.deliver(ctx, d)
 }
 
+// s3KeyPrefix begins the name of each object that S3Store writes.
+const s3KeyPrefix = "pprof/"
+
 func s3Key(m *autoprof.ArchiveMeta) string {
-	return fmt.Sprintf("pprof/%s/%s/%s/%s",
-		url.PathEscape(m.Main),
-		url.PathEscape(m.Hostname),
-		url.PathEscape(m.ProcID),
-		url.PathEscape(m.CaptureTime))
+	return s3KeyPrefix + autoprof.BundleKey(m)
 }
@@ -0,0 +1,469 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// An S3Store is an autoprof.Store which keeps profile bundles as objects in an
+// Amazon S3 bucket, or in another service that implements the same API. It
+// signs its requests with AWS Signature Version 4, and uses path-style URLs
+// (which include the bucket name in the path) so it can work with services
+// other than S3 itself.
+//
+// The name of each object is "pprof/" followed by the bundle's key.
+type S3Store struct {
+	// Endpoint is the base URL of the service, such as
+	// "http://localhost:9000". If empty, the store uses the S3 endpoint for
+	// the Region.
+	Endpoint string
+	// Region is the AWS region of the bucket, such as "us-west-2". Services
+	// other than S3 may require a particular value here, often "us-east-1".
+	Region string
+	// Bucket is the name of the bucket that holds the bundles.
+	Bucket string
+
+	// AccessKeyID and SecretAccessKey are the credentials for signing
+	// requests. SessionToken is also required when using temporary
+	// credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the size of each part of a multipart upload. Bundles that
+	// are larger than this, usually because they include a long execution
+	// trace, use a multipart upload. S3 requires parts of at least 5 MiB. If
+	// zero, the store uses parts of 16 MiB.
+	PartSize int64
+
+	// Client makes the HTTP requests. If nil, the store uses
+	// http.DefaultClient.
+	Client *http.Client
+
+	// now returns the time to use for signing requests.
+	now func() time.Time
+}
+
+var _ autoprof.Store = (*S3Store)(nil)
+
+const (
+	defaultS3PartSize = 16 << 20
+
+	// emptySHA256 is the hex-encoded SHA-256 hash of an empty request body.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Put uploads the bundle, using a multipart upload if it's larger than
+// PartSize.
+func (s *S3Store) Put(ctx context.Context, meta *autoprof.ArchiveMeta, bundle []byte) error {
+	key := s3Key(meta)
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+	if int64(len(bundle)) > partSize {
+		return s.putMultipart(ctx, key, bundle, partSize)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, nil, bundle, func(h http.Header) {
+		h.Set("Content-Type", "application/zip")
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []*s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3Store) putMultipart(ctx context.Context, key string, bundle []byte, partSize int64) (err error) {
+	var initiate s3InitiateMultipartUploadResult
+	err = s.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, func(h http.Header) {
+		h.Set("Content-Type", "application/zip")
+	}, &initiate)
+	if err != nil {
+		return err
+	}
+	upload := url.Values{"uploadId": {initiate.UploadID}}
+	defer func() {
+		if err != nil {
+			// Abort the upload so the service can discard the parts.
+			// There's no way to report a failure here, so ignore it.
+			resp, err := s.do(context.Background(), http.MethodDelete, key, upload, nil, nil)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var complete s3CompleteMultipartUpload
+	for i := 0; len(bundle) > 0; i++ {
+		part := bundle
+		if int64(len(part)) > partSize {
+			part = part[:partSize]
+		}
+		bundle = bundle[len(part):]
+
+		num := i + 1
+		q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {initiate.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, q, part, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, &s3CompletePart{PartNumber: num, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	// The service may report a failure to complete the upload in the body
+	// of a successful response, so read it.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	err = s.doXML(ctx, http.MethodPost, key, upload, body, nil, &result)
+	if err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return &s3Error{method: http.MethodPost, key: key, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List describes the bundles in the bucket whose keys begin with prefix. It
+// ignores objects whose names do not match the layout of bundle keys.
+func (s *S3Store) List(ctx context.Context, prefix string) ([]*autoprof.StoredBundle, error) {
+	var list []*autoprof.StoredBundle
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s3KeyPrefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var result s3ListBucketResult
+		err := s.doXML(ctx, http.MethodGet, "", q, nil, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			sb, err := autoprof.ParseBundleKey(strings.TrimPrefix(obj.Key, s3KeyPrefix))
+			if err != nil {
+				continue
+			}
+			sb.Size = obj.Size
+			list = append(list, sb)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// Get downloads the bundle with the provided key.
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	_, err := autoprof.ParseBundleKey(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s3KeyPrefix+key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes the bundle with the provided key.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := autoprof.ParseBundleKey(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s3KeyPrefix+key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// An s3Error describes a failed request, including the details from the
+// service's XML error response when available.
+type s3Error struct {
+	method string
+	key    string
+	status int
+
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	msg := fmt.Sprintf("s3 %s %q:", e.method, e.key)
+	if e.status != 0 {
+		msg += fmt.Sprintf(" status %d", e.status)
+	}
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Is allows errors.Is to match a missing object with fs.ErrNotExist, and a
+// request that the service will never accept with ErrPermanent.
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.status == http.StatusNotFound
+	case ErrPermanent:
+		return permanentS3Codes[e.Code]
+	}
+	return false
+}
+
+// permanentS3Codes lists the S3 error codes that describe a problem with the
+// object itself, such as a bundle that's too large, which retrying the same
+// request can't fix. Other errors, including many with a 4xx status (such as
+// ExpiredToken, RequestTimeout, BadDigest, and RequestTimeTooSkewed), describe
+// the credentials, the connection, or the store's state, all of which may
+// change.
+var permanentS3Codes = map[string]bool{
+	"EntityTooLarge":   true,
+	"EntityTooSmall":   true,
+	"InvalidArgument":  true,
+	"KeyTooLongError":  true,
+	"MetadataTooLarge": true,
+}
+
+// doXML makes a request and decodes its XML response into v.
+func (s *S3Store) doXML(ctx context.Context, method, key string, query url.Values, body []byte, setHeader func(http.Header), v interface{}) error {
+	resp, err := s.do(ctx, method, key, query, body, setHeader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("s3 %s %q: %w", method, key, err)
+	}
+	return nil
+}
+
+// do makes a signed request for the named object, or for the bucket itself
+// when key is empty. It returns an error for any response other than 2xx.
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, body []byte, setHeader func(http.Header)) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/" + awsURIEncode(s.Bucket, true)
+	if key != "" {
+		u += "/" + awsURIEncode(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + awsCanonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if setHeader != nil {
+		setHeader(req.Header)
+	}
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		payloadHash = hexSHA256(body)
+	}
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	signV4(req, payloadHash, now(), s.Region, s.AccessKeyID, s.SecretAccessKey)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{method: method, key: key, status: resp.StatusCode}
+		// The response body usually has more details, but not always (such
+		// as for HEAD requests).
+		xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// signV4 adds the headers for AWS Signature Version 4 to the request for the
+// S3 service. It signs the Host header along with all headers already present
+// in the request.
+func signV4(req *http.Request, payloadHash string, t time.Time, region, accessKeyID, secretAccessKey string) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(k)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsCanonicalQuery encodes the query parameters sorted by name and then
+// value, as AWS Signature Version 4 requires.
+func awsCanonicalQuery(q url.Values) string {
+	var params [][2]string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, [2]string{awsURIEncode(k, true), awsURIEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	var b strings.Builder
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(p[0] + "=" + p[1])
+	}
+	return b.String()
+}
+
+// awsURIEncode percent-encodes all bytes other than the unreserved characters
+// of RFC 3986, and optionally "/".
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package periodic
+
+import (
+	"sort"
+	"time"
+)
+
+// A Schedule controls when a Collector builds each bundle and which data each
+// bundle includes. Zero-valued fields take their value from DefaultSchedule.
+type Schedule struct {
+	// Interval is the upper limit on the time between bundles: from the end
+	// of one to the start of the next.
+	Interval time.Duration
+	// Jitter is the largest fraction by which to randomly shorten each
+	// Interval, which results in slightly more frequent bundles on average.
+	// A negative value disables jitter.
+	Jitter float64
+	// FirstJitter is like Jitter, but applies to the wait for the first
+	// bundle.
+	FirstJitter float64
+	// FirstRunTimeBased allows the first bundle to include a CPU profile and
+	// execution trace. By default, the first bundle includes only
+	// point-in-time data, for a good chance of getting at least a little data
+	// from short-lived processes.
+	FirstRunTimeBased bool
+
+	// CPUProfileDuration, CPUProfileByteTarget, ExecutionTraceDuration, and
+	// ExecutionTraceByteTarget have the same meaning as the fields of
+	// autoprof.ArchiveOptions, for the bundles that include a CPU profile or
+	// execution trace. Because zero means the default, a negative
+	// CPUProfileDuration or ExecutionTraceDuration turns that profile off.
+	CPUProfileDuration       time.Duration
+	CPUProfileByteTarget     int64
+	ExecutionTraceDuration   time.Duration
+	ExecutionTraceByteTarget int64
+
+	// Profiles controls how often bundles include each kind of data, by name:
+	// "profile" for the CPU profile, "trace" for the execution trace, or the
+	// name of a runtime/pprof profile such as "goroutine". Data without an
+	// entry is in every bundle, except for the execution trace which follows
+	// the policy from DefaultSchedule. The first bundle, when it leaves out
+	// the CPU profile and execution trace because FirstRunTimeBased is unset,
+	// does not count against their policies.
+	Profiles map[string]ProfilePolicy
+}
+
+// A ProfilePolicy controls how often bundles include one kind of data. The
+// data is in a bundle when the bundle count and the time since the data's
+// previous appearance both meet the policy.
+type ProfilePolicy struct {
+	// Every is the number of bundles from one that includes the data to the
+	// next, so 1 means every bundle and 2 means every other bundle. Zero is
+	// the same as one, and a negative value means no bundles.
+	Every int
+	// Random adds a random number of bundles, less than Random, to each gap
+	// that Every describes.
+	Random int
+	// Interval is the minimum time from one bundle that includes the data to
+	// the next.
+	Interval time.Duration
+}
+
+// DefaultSchedule returns the schedule that a Collector uses when its
+// Schedule field is nil. It builds a bundle about every two minutes, with
+// a five-second CPU profile in each. Execution traces are often quite large,
+// and are harder to analyze in aggregate in the same ways that pprof-formatted
+// profiles can, so it includes a one-second trace in about one of every fifty
+// bundles.
+func DefaultSchedule() *Schedule {
+	return &Schedule{
+		Interval:    2 * time.Minute,
+		Jitter:      0.2,
+		FirstJitter: 1,
+
+		CPUProfileDuration:       5 * time.Second,
+		CPUProfileByteTarget:     1e6,
+		ExecutionTraceDuration:   1 * time.Second,
+		ExecutionTraceByteTarget: 1e7,
+
+		Profiles: map[string]ProfilePolicy{
+			"trace": {Every: 1, Random: 100},
+		},
+	}
+}
+
+// withDefaults returns a copy of the schedule with its zero-valued fields set
+// from DefaultSchedule.
+func (s *Schedule) withDefaults() *Schedule {
+	def := DefaultSchedule()
+	if s == nil {
+		return def
+	}
+	out := *s
+	if out.Interval <= 0 {
+		out.Interval = def.Interval
+	}
+	if out.Jitter == 0 {
+		out.Jitter = def.Jitter
+	}
+	if out.FirstJitter == 0 {
+		out.FirstJitter = def.FirstJitter
+	}
+	if out.CPUProfileDuration == 0 {
+		out.CPUProfileDuration = def.CPUProfileDuration
+	}
+	if out.CPUProfileByteTarget == 0 {
+		out.CPUProfileByteTarget = def.CPUProfileByteTarget
+	}
+	if out.ExecutionTraceDuration == 0 {
+		out.ExecutionTraceDuration = def.ExecutionTraceDuration
+	}
+	if out.ExecutionTraceByteTarget == 0 {
+		out.ExecutionTraceByteTarget = def.ExecutionTraceByteTarget
+	}
+	out.Profiles = make(map[string]ProfilePolicy)
+	for name, policy := range def.Profiles {
+		out.Profiles[name] = policy
+	}
+	for name, policy := range s.Profiles {
+		out.Profiles[name] = policy
+	}
+	return &out
+}
+
+// profileState tracks when a kind of data last appeared in a bundle.
+type profileState struct {
+	next int
+	last time.Time
+}
+
+// excludedProfiles decides which of the data with policies to include in
+// bundle i, and notes the choice for future bundles. It returns the names of
+// the data to leave out.
+func (r *runner) excludedProfiles(s *Schedule, i int, now time.Time) []string {
+	if r.profiles == nil {
+		r.profiles = make(map[string]*profileState)
+	}
+
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	// Consume random numbers in a consistent order.
+	sort.Strings(names)
+
+	var exclude []string
+	for _, name := range names {
+		if i == 0 && !s.FirstRunTimeBased && (name == "profile" || name == "trace") {
+			// The first bundle has no time-based profiles, so their
+			// policies start with the next one. A random policy still
+			// spreads its first appearance over the bundles after that,
+			// as though the first bundle had counted.
+			exclude = append(exclude, name)
+			if policy := s.Profiles[name]; policy.Random > 0 && r.profiles[name] == nil {
+				r.profiles[name] = &profileState{next: 1 + r.rng.Intn(policy.Random)}
+			}
+			continue
+		}
+		policy := s.Profiles[name]
+		state := r.profiles[name]
+		if state == nil {
+			state = &profileState{next: i}
+			r.profiles[name] = state
+		}
+
+		due := policy.Every >= 0 && i >= state.next &&
+			(state.last.IsZero() || now.Sub(state.last) >= policy.Interval)
+		if !due {
+			exclude = append(exclude, name)
+			continue
+		}
+
+		every := policy.Every
+		if every == 0 {
+			every = 1
+		}
+		state.next = i + every
+		if policy.Random > 0 {
+			state.next += r.rng.Intn(policy.Random)
+		}
+		state.last = now
+	}
+	return exclude
+}
@@ -0,0 +1,144 @@
+package periodic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDefaultSchedule(t *testing.T) {
+	r := &runner{
+		c:        &Collector{},
+		rng:      rand.New(rand.NewSource(1)),
+		schedule: (*Schedule)(nil).withDefaults(),
+	}
+
+	var cpu, traces int
+	const n = 1000
+	for i := 0; i < n; i++ {
+		opts := r.options(i)
+		if i == 0 && (opts.CPUProfileDuration != 0 || opts.ExecutionTraceDuration != 0) {
+			t.Errorf("first bundle includes time-based profiles")
+		}
+		if opts.CPUProfileDuration > 0 {
+			cpu++
+			if have, want := opts.CPUProfileDuration, 5*time.Second; have != want {
+				t.Errorf("CPUProfileDuration; %s != %s", have, want)
+			}
+		}
+		if opts.ExecutionTraceDuration > 0 {
+			traces++
+		}
+		if len(opts.ExcludeProfiles) > 0 {
+			t.Errorf("bundle %d excludes %q", i, opts.ExcludeProfiles)
+		}
+	}
+	if have, want := cpu, n-1; have != want {
+		t.Errorf("found %d CPU profiles, expected %d", have, want)
+	}
+	// About one trace per fifty bundles
+	if traces < n/100 || traces > n/25 {
+		t.Errorf("found %d execution traces in %d bundles", traces, n)
+	}
+}
+
+func TestScheduleProfiles(t *testing.T) {
+	s := (&Schedule{
+		FirstRunTimeBased: true,
+		Profiles: map[string]ProfilePolicy{
+			"profile": {Every: 2},
+			"trace":   {Interval: time.Hour},
+			"mutex":   {Every: -1},
+		},
+	}).withDefaults()
+	r := &runner{rng: rand.New(rand.NewSource(1))}
+
+	start := time.Now()
+	var have []string
+	for i := 0; i < 8; i++ {
+		now := start.Add(time.Duration(i) * 20 * time.Minute)
+		var line string
+		for _, name := range r.excludedProfiles(s, i, now) {
+			line += name[:1]
+		}
+		have = append(have, line)
+	}
+
+	// "m" for mutex, "p" for CPU profile, "t" for trace
+	want := []string{"m", "mpt", "mt", "mp", "mt", "mpt", "m", "mpt"}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("excluded profiles %q, expected %q", have, want)
+			break
+		}
+	}
+}
+
+func TestScheduleFirstRun(t *testing.T) {
+	r := &runner{
+		c:   &Collector{},
+		rng: rand.New(rand.NewSource(1)),
+		schedule: (&Schedule{
+			Profiles: map[string]ProfilePolicy{
+				"profile": {Every: 2},
+				"trace":   {Every: 3},
+			},
+		}).withDefaults(),
+	}
+
+	// The first bundle leaves out the time-based profiles without using up
+	// their turns, so the second bundle has both.
+	var have []string
+	for i := 0; i < 5; i++ {
+		opts := r.options(i)
+		var line string
+		if opts.CPUProfileDuration > 0 {
+			line += "p"
+		}
+		if opts.ExecutionTraceDuration > 0 {
+			line += "t"
+		}
+		have = append(have, line)
+	}
+	want := []string{"", "pt", "", "p", "t"}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("included profiles %q, expected %q", have, want)
+			break
+		}
+	}
+
+	// The default trace policy spreads the first trace over the following
+	// bundles, rather than always putting it in the second.
+	var traced int
+	for seed := int64(0); seed < 100; seed++ {
+		r := &runner{
+			c:        &Collector{},
+			rng:      rand.New(rand.NewSource(seed)),
+			schedule: DefaultSchedule(),
+		}
+		r.options(0)
+		if r.options(1).ExecutionTraceDuration > 0 {
+			traced++
+		}
+	}
+	if traced > 10 {
+		t.Errorf("second bundle had a trace for %d of 100 seeds", traced)
+	}
+
+	// A negative duration turns a profile off.
+	r = &runner{
+		c:   &Collector{},
+		rng: rand.New(rand.NewSource(1)),
+		schedule: (&Schedule{
+			CPUProfileDuration:     -1,
+			ExecutionTraceDuration: -1,
+			FirstRunTimeBased:      true,
+			Profiles:               map[string]ProfilePolicy{"trace": {}},
+		}).withDefaults(),
+	}
+	opts := r.options(0)
+	if opts.CPUProfileDuration != 0 || opts.ExecutionTraceDuration != 0 {
+		t.Errorf("disabled profiles; CPU %s, trace %s", opts.CPUProfileDuration, opts.ExecutionTraceDuration)
+	}
+}
@@ -0,0 +1,278 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+// A SpoolStore is an autoprof.Store which writes each profile bundle to a
+// local spool directory, and then uploads it to another Store in the
+// background. It allows a Collector to continue collecting bundles while that
+// Backend is slow or unavailable.
+//
+// The uploads happen only while the Run method is active. When Run starts, it
+// also uploads any bundles left in the spool directory by earlier processes.
+//
+// When the Backend rejects a bundle with an error that matches ErrPermanent,
+// the store moves the bundle into the "%rejected" subdirectory of Dir rather
+// than retrying it, so that it can't hold up the bundles behind it. That
+// subdirectory has its own MaxBytes limit, beyond which the store discards the
+// oldest rejected bundles.
+type SpoolStore struct {
+	// Dir is the spool directory.
+	Dir string
+	// MaxBytes limits the total size of the bundles in the spool directory,
+	// and separately of those that the Backend rejected. When a new bundle
+	// would exceed the limit, the store discards the oldest bundles that it
+	// has not yet uploaded. If zero, the spool is unlimited.
+	MaxBytes int64
+
+	// Backend receives the bundles.
+	Backend autoprof.Store
+
+	// MinBackoff and MaxBackoff control the delay before retrying a failed
+	// upload, which doubles after each consecutive failure. If zero, they
+	// default to one second and five minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	once     sync.Once
+	spool    *DirStore
+	rejected *DirStore
+	wake     chan struct{}
+}
+
+var _ autoprof.Store = (*SpoolStore)(nil)
+
+const (
+	defaultMinBackoff = 1 * time.Second
+	defaultMaxBackoff = 5 * time.Minute
+
+	// spoolRejectedDir holds the bundles that the Backend rejected. No
+	// escaped key element can equal its name.
+	spoolRejectedDir = "%rejected"
+)
+
+// ErrPermanent marks a failure to store a bundle that retrying will not fix,
+// such as when the Backend rejects the bundle's contents or key. A Store can
+// wrap it, or return an error whose Is method matches it.
+var ErrPermanent = errors.New("permanent failure")
+
+func (s *SpoolStore) init() {
+	s.once.Do(func() {
+		s.spool = &DirStore{Dir: s.Dir, MaxBytes: s.MaxBytes}
+		s.rejected = &DirStore{Dir: filepath.Join(s.Dir, spoolRejectedDir), MaxBytes: s.MaxBytes}
+		s.wake = make(chan struct{}, 1)
+	})
+}
+
+// Put writes the bundle to the spool directory. It returns once the bundle is
+// safely on disk, without waiting for the upload.
+func (s *SpoolStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	s.init()
+	err := s.spool.Put(ctx, meta, buf)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// List describes the bundles in the Backend along with those that are waiting
+// in the spool directory.
+func (s *SpoolStore) List(ctx context.Context, prefix string) ([]*autoprof.StoredBundle, error) {
+	s.init()
+	list, err := s.Backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	spooled, err := s.spool.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(list))
+	for _, sb := range list {
+		seen[sb.Key] = true
+	}
+	for _, sb := range spooled {
+		if !seen[sb.Key] {
+			list = append(list, sb)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// Get returns the bundle from the spool directory if it's waiting there, or
+// otherwise from the Backend.
+func (s *SpoolStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.init()
+	buf, err := s.spool.Get(ctx, key)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return buf, err
+	}
+	return s.Backend.Get(ctx, key)
+}
+
+// Delete removes the bundle from the spool directory and from the Backend.
+func (s *SpoolStore) Delete(ctx context.Context, key string) error {
+	s.init()
+	spoolErr := s.spool.Delete(ctx, key)
+	if spoolErr != nil && !errors.Is(spoolErr, fs.ErrNotExist) {
+		return spoolErr
+	}
+	err := s.Backend.Delete(ctx, key)
+	if spoolErr == nil && errors.Is(err, fs.ErrNotExist) {
+		// The bundle hadn't been uploaded yet.
+		return nil
+	}
+	return err
+}
+
+// Run uploads the bundles in the spool directory to the Backend, oldest first,
+// until the context ends. It retries failed uploads with exponential backoff.
+func (s *SpoolStore) Run(ctx context.Context) error {
+	s.init()
+
+	minBackoff, maxBackoff := s.MinBackoff, s.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	backoff := minBackoff
+
+	for {
+		uploaded, err := s.uploadOldest(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		if uploaded {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.wake:
+		}
+	}
+}
+
+// uploadOldest uploads the oldest bundle in the spool directory and removes it
+// from the spool. It reports whether there was a bundle to upload.
+func (s *SpoolStore) uploadOldest(ctx context.Context) (bool, error) {
+	files, err := s.spool.walk()
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if a, b := files[i].modTime, files[j].modTime; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return files[i].sb.Key < files[j].sb.Key
+	})
+	f := files[0]
+
+	buf, err := os.ReadFile(f.name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The spool's retention limit removed it.
+			return true, nil
+		}
+		return false, err
+	}
+	err = s.Backend.Put(ctx, spooledMeta(f.sb, buf), buf)
+	if errors.Is(err, ErrPermanent) {
+		s.spool.mu.Lock()
+		defer s.spool.mu.Unlock()
+		err = s.reject(f.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.spool.mu.Lock()
+	defer s.spool.mu.Unlock()
+	err = s.spool.remove(f.name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// reject moves the named bundle file out of the spool and into the rejected
+// directory, and then enforces that directory's limit. The caller must hold
+// s.spool.mu.
+func (s *SpoolStore) reject(name string) error {
+	rel, err := filepath.Rel(s.Dir, name)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(s.rejected.Dir, rel)
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(name, dst)
+	if err != nil {
+		return err
+	}
+	prune(filepath.Dir(name))
+
+	s.rejected.mu.Lock()
+	defer s.rejected.mu.Unlock()
+	return s.rejected.enforceRetention(time.Now())
+}
+
+// spooledMeta returns the metadata of a bundle from the spool directory. It
+// reads the bundle's own copy, or if that fails (as it might for a partial
+// bundle), uses the parts of the metadata that make up its key.
+func spooledMeta(sb *autoprof.StoredBundle, buf []byte) *autoprof.ArchiveMeta {
+	b, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+	if err == nil && autoprof.BundleKey(&b.Meta) == sb.Key {
+		return &b.Meta
+	}
+	return &autoprof.ArchiveMeta{
+		Main:        sb.Main,
+		Hostname:    sb.Hostname,
+		ProcID:      sb.ProcID,
+		CaptureTime: sb.CaptureTime,
+	}
+}
@@ -0,0 +1,303 @@
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+var errUnavailable = errors.New("backend unavailable")
+
+// memStore is an autoprof.Store that holds bundles in memory, and which can
+// simulate an outage.
+type memStore struct {
+	mu      sync.Mutex
+	down    bool
+	bundles map[string][]byte
+	metas   map[string]*autoprof.ArchiveMeta
+	puts    chan string
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		bundles: make(map[string][]byte),
+		metas:   make(map[string]*autoprof.ArchiveMeta),
+		puts:    make(chan string, 100),
+	}
+}
+
+func (s *memStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *memStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errUnavailable
+	}
+	key := autoprof.BundleKey(meta)
+	s.bundles[key] = buf
+	s.metas[key] = meta
+	s.puts <- key
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) ([]*autoprof.StoredBundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*autoprof.StoredBundle
+	for key, buf := range s.bundles {
+		if strings.HasPrefix(key, prefix) {
+			sb, err := autoprof.ParseBundleKey(key)
+			if err != nil {
+				return nil, err
+			}
+			sb.Size = int64(len(buf))
+			list = append(list, sb)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.bundles[key]
+	if !ok {
+		return nil, fmt.Errorf("bundle %q: %w", key, fs.ErrNotExist)
+	}
+	return buf, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bundles[key]; !ok {
+		return fmt.Errorf("bundle %q: %w", key, fs.ErrNotExist)
+	}
+	delete(s.bundles, key)
+	return nil
+}
+
+func TestSpoolStore(t *testing.T) {
+	ctx := context.Background()
+
+	// A real bundle, to show that the spool recovers the full metadata.
+	meta := autoprof.CurrentArchiveMeta()
+	meta.Labels = autoprof.NewLabels(map[string]string{"spool": "test"})
+	var zip bytes.Buffer
+	err := autoprof.NewZipCollector(&zip, meta, &autoprof.ArchiveOptions{
+		IncludeProfiles: []string{"goroutine"},
+	}).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run; err = %v", err)
+	}
+
+	dir := t.TempDir()
+	backend := newMemStore()
+	backend.setDown(true)
+
+	// Write some bundles while nothing is uploading them, as before a
+	// restart.
+	s := &SpoolStore{Dir: dir, Backend: backend}
+	err = s.Put(ctx, meta, zip.Bytes())
+	if err != nil {
+		t.Fatalf("Put; err = %v", err)
+	}
+	err = s.Put(ctx, testMeta(1), []byte("not a zip file"))
+	if err != nil {
+		t.Fatalf("Put; err = %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(s.spool.path(autoprof.BundleKey(meta)), old, old)
+	if err != nil {
+		t.Fatalf("Chtimes; err = %v", err)
+	}
+	if have, want := len(listKeys(t, s, "")), 2; have != want {
+		t.Errorf("List; found %d bundles, expected %d", have, want)
+	}
+
+	// A new store finds the bundles that remain in the spool.
+	s = &SpoolStore{Dir: dir, Backend: backend, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run(ctx) }()
+
+	time.Sleep(20 * time.Millisecond)
+	backend.setDown(false)
+
+	recv := func() string {
+		select {
+		case key := <-backend.puts:
+			return key
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for upload")
+			return ""
+		}
+	}
+	first, second := recv(), recv()
+	if have, want := first, autoprof.BundleKey(meta); have != want {
+		t.Errorf("first upload; %q != %q", have, want)
+	}
+	if have, want := second, autoprof.BundleKey(testMeta(1)); have != want {
+		t.Errorf("second upload; %q != %q", have, want)
+	}
+	if have, want := backend.metas[first].Labels.Get("spool"), "test"; have != want {
+		t.Errorf("recovered meta label; %q != %q", have, want)
+	}
+
+	// New bundles upload promptly.
+	err = s.Put(ctx, testMeta(2), []byte("bundle 2"))
+	if err != nil {
+		t.Fatalf("Put; err = %v", err)
+	}
+	if have, want := recv(), autoprof.BundleKey(testMeta(2)); have != want {
+		t.Errorf("third upload; %q != %q", have, want)
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Run; err = %v", err)
+	}
+	if keys := listKeys(t, s.spool, ""); len(keys) != 0 {
+		t.Errorf("spool still holds %q", keys)
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		s := &SpoolStore{Dir: t.TempDir(), Backend: newMemStore(), MaxBytes: 250}
+		for i := 0; i < 5; i++ {
+			err := s.Put(context.Background(), testMeta(i), make([]byte, 100))
+			if err != nil {
+				t.Fatalf("Put; err = %v", err)
+			}
+		}
+		keys := listKeys(t, s, "")
+		if have, want := len(keys), 2; have != want {
+			t.Fatalf("spool holds %d bundles, expected %d", have, want)
+		}
+		if have, want := keys[0], autoprof.BundleKey(testMeta(3)); have != want {
+			t.Errorf("oldest remaining bundle; %q != %q", have, want)
+		}
+	})
+}
+
+// rejectingStore is a memStore which permanently rejects one bundle, or all
+// of them if reject is empty.
+type rejectingStore struct {
+	*memStore
+	reject string
+}
+
+func (s *rejectingStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	if s.reject == "" || autoprof.BundleKey(meta) == s.reject {
+		return fmt.Errorf("bundle too large: %w", ErrPermanent)
+	}
+	return s.memStore.Put(ctx, meta, buf)
+}
+
+func TestSpoolStoreRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	backend := &rejectingStore{memStore: newMemStore(), reject: autoprof.BundleKey(testMeta(0))}
+	s := &SpoolStore{Dir: dir, Backend: backend, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	// The oldest bundle is the one that the backend rejects.
+	for i := 0; i < 2; i++ {
+		err := s.Put(ctx, testMeta(i), []byte(fmt.Sprintf("bundle %d", i)))
+		if err != nil {
+			t.Fatalf("Put; err = %v", err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	err := os.Chtimes(s.spool.path(autoprof.BundleKey(testMeta(0))), old, old)
+	if err != nil {
+		t.Fatalf("Chtimes; err = %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run(ctx) }()
+
+	select {
+	case key := <-backend.puts:
+		if have, want := key, autoprof.BundleKey(testMeta(1)); have != want {
+			t.Errorf("upload; %q != %q", have, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("rejected bundle blocked the newer one")
+	}
+	cancel()
+	<-errCh
+
+	if keys := listKeys(t, s.spool, ""); len(keys) != 0 {
+		t.Errorf("spool still holds %q", keys)
+	}
+	rejected := (&DirStore{Dir: filepath.Join(dir, spoolRejectedDir)}).path(autoprof.BundleKey(testMeta(0)))
+	buf, err := os.ReadFile(rejected)
+	if err != nil {
+		t.Fatalf("ReadFile(rejected); err = %v", err)
+	}
+	if have, want := string(buf), "bundle 0"; have != want {
+		t.Errorf("rejected bundle; %q != %q", have, want)
+	}
+}
+
+func TestSpoolStoreRejectedLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	backend := &rejectingStore{memStore: newMemStore()}
+	s := &SpoolStore{Dir: dir, Backend: backend, MaxBytes: 20, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run(ctx) }()
+
+	// Each bundle is 8 bytes, so the rejected directory can hold only the
+	// two newest of them.
+	for i := 0; i < 4; i++ {
+		err := s.Put(ctx, testMeta(i), []byte(fmt.Sprintf("bundle %d", i)))
+		if err != nil {
+			t.Fatalf("Put; err = %v", err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for len(listKeys(t, s.spool, "")) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("bundle %d is still in the spool", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		old := time.Now().Add(time.Duration(i-4) * time.Hour)
+		err = os.Chtimes(s.rejected.path(autoprof.BundleKey(testMeta(i))), old, old)
+		if err != nil {
+			t.Fatalf("Chtimes; err = %v", err)
+		}
+	}
+	cancel()
+	<-errCh
+
+	keys := listKeys(t, s.rejected, "")
+	if have, want := fmt.Sprint(keys), fmt.Sprint([]string{
+		autoprof.BundleKey(testMeta(2)),
+		autoprof.BundleKey(testMeta(3)),
+	}); have != want {
+		t.Errorf("rejected bundles; %s != %s", have, want)
+	}
+}
@@ -0,0 +1,80 @@
+package autoprof
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A Store holds profile bundles. Each bundle in a Store has a key, as
+// described by BundleKey.
+type Store interface {
+	// Put stores the profile bundle that meta describes.
+	Put(ctx context.Context, meta *ArchiveMeta, bundle []byte) error
+	// List describes the stored profile bundles whose keys begin with
+	// prefix, ordered by key.
+	List(ctx context.Context, prefix string) ([]*StoredBundle, error)
+	// Get returns the contents of the profile bundle with the provided key.
+	// If there is no such bundle, the error matches fs.ErrNotExist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the profile bundle with the provided key.
+	Delete(ctx context.Context, key string) error
+}
+
+// A StoredBundle describes a profile bundle within a Store.
+type StoredBundle struct {
+	// Key identifies the bundle within the Store.
+	Key string `json:"key"`
+
+	// Main, Hostname, ProcID, and CaptureTime are the values of the
+	// bundle's ArchiveMeta fields of the same names.
+	Main        string `json:"main"`
+	Hostname    string `json:"hostname"`
+	ProcID      string `json:"proc_id"`
+	CaptureTime string `json:"capture_time"`
+
+	// Size is the length of the bundle, in bytes.
+	Size int64 `json:"size"`
+}
+
+// BundleKey returns the key that identifies the profile bundle that meta
+// describes within a Store. The key is made of the path-escaped values of the
+// Main, Hostname, ProcID, and CaptureTime fields, separated by "/". Listing a
+// Store with a prefix of a key's first elements finds all the bundles from the
+// same program, host, or process.
+func BundleKey(meta *ArchiveMeta) string {
+	return strings.Join([]string{
+		url.PathEscape(meta.Main),
+		url.PathEscape(meta.Hostname),
+		url.PathEscape(meta.ProcID),
+		url.PathEscape(meta.CaptureTime),
+	}, "/")
+}
+
+var errInvalidKey = errors.New("invalid bundle key")
+
+// ParseBundleKey returns a description of the profile bundle with the
+// provided key, as BundleKey would generate. The Size field of the result is
+// zero.
+func ParseBundleKey(key string) (*StoredBundle, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("%w %q", errInvalidKey, key)
+	}
+	for i, part := range parts {
+		v, err := url.PathUnescape(part)
+		if err != nil || v == "." || v == ".." || url.PathEscape(v) != part {
+			return nil, fmt.Errorf("%w %q", errInvalidKey, key)
+		}
+		parts[i] = v
+	}
+	return &StoredBundle{
+		Key:         key,
+		Main:        parts[0],
+		Hostname:    parts[1],
+		ProcID:      parts[2],
+		CaptureTime: parts[3],
+	}, nil
+}
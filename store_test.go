@@ -0,0 +1,52 @@
+package autoprof
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBundleKey(t *testing.T) {
+	meta := &ArchiveMeta{
+		Main:        "example.com/cmd/server",
+		Hostname:    "host-1",
+		ProcID:      "0123abcd",
+		CaptureTime: "2021-03-04T05:06:07.890Z",
+	}
+	key := BundleKey(meta)
+	if have, want := key, "example.com%2Fcmd%2Fserver/host-1/0123abcd/2021-03-04T05:06:07.890Z"; have != want {
+		t.Errorf("BundleKey; %q != %q", have, want)
+	}
+
+	sb, err := ParseBundleKey(key)
+	if err != nil {
+		t.Fatalf("ParseBundleKey; err = %v", err)
+	}
+	if sb.Key != key || sb.Main != meta.Main || sb.Hostname != meta.Hostname ||
+		sb.ProcID != meta.ProcID || sb.CaptureTime != meta.CaptureTime {
+		t.Errorf("ParseBundleKey(%q) = %+v", key, sb)
+	}
+
+	// Empty fields keep their place in the key.
+	sb, err = ParseBundleKey(BundleKey(&ArchiveMeta{ProcID: "0123abcd"}))
+	if err != nil {
+		t.Fatalf("ParseBundleKey; err = %v", err)
+	}
+	if sb.ProcID != "0123abcd" {
+		t.Errorf("ParseBundleKey; ProcID %q", sb.ProcID)
+	}
+
+	for _, key := range []string{
+		"",
+		"a/b/c",
+		"a/b/c/d/e",
+		"a/../c/d",
+		"a/b/c/%zz",
+		"a/b/c/d%2fe",
+		"a/b/c/d%2Ee",
+	} {
+		_, err := ParseBundleKey(key)
+		if !errors.Is(err, errInvalidKey) {
+			t.Errorf("ParseBundleKey(%q); err = %v", key, err)
+		}
+	}
+}
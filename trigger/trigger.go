@@ -0,0 +1,192 @@
+// Package trigger collects profile bundles when the process's runtime metrics
+// or expvar values cross a threshold, to capture the moments that periodic
+// collection is likely to miss.
+package trigger
+
+import (
+	"expvar"
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"time"
+)
+
+// A Trigger is a condition that prompts a Watcher to collect a profile bundle.
+// It fires when its Value reaches its Threshold. After it fires, it does not
+// fire again until its Value has dropped back below the Threshold.
+type Trigger struct {
+	// Name identifies the trigger in the metadata of the bundles it prompts.
+	Name string
+	// Threshold is the limit at or above which the trigger fires.
+	Threshold float64
+	// Value returns the current measurement. It reports false if the
+	// measurement is unavailable, such as when the runtime does not provide
+	// the metric, or when the trigger needs more than one reading to compute
+	// a rate. A Watcher calls Value from a single goroutine.
+	Value func() (float64, bool)
+}
+
+const (
+	metricHeapObjects  = "/memory/classes/heap/objects:bytes"
+	metricHeapUnused   = "/memory/classes/heap/unused:bytes"
+	metricGoroutines   = "/sched/goroutines:goroutines"
+	metricCPUTotal     = "/cpu/classes/total:cpu-seconds"
+	metricCPUGC        = "/cpu/classes/gc/total:cpu-seconds"
+	metricSchedLatency = "/sched/latencies:seconds"
+)
+
+// HeapInUse returns a Trigger which fires when the heap's in-use spans,
+// including both live objects and the unused space within those spans, reach
+// the provided size in bytes.
+func HeapInUse(bytes uint64) *Trigger {
+	return &Trigger{
+		Name:      "heap_inuse",
+		Threshold: float64(bytes),
+		Value: func() (float64, bool) {
+			samples := []metrics.Sample{{Name: metricHeapObjects}, {Name: metricHeapUnused}}
+			metrics.Read(samples)
+			if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+				return 0, false
+			}
+			return float64(samples[0].Value.Uint64() + samples[1].Value.Uint64()), true
+		},
+	}
+}
+
+// Goroutines returns a Trigger which fires when the number of live goroutines
+// reaches n.
+func Goroutines(n int) *Trigger {
+	return &Trigger{
+		Name:      "goroutines",
+		Threshold: float64(n),
+		Value: func() (float64, bool) {
+			samples := []metrics.Sample{{Name: metricGoroutines}}
+			metrics.Read(samples)
+			if samples[0].Value.Kind() != metrics.KindUint64 {
+				return 0, false
+			}
+			return float64(samples[0].Value.Uint64()), true
+		},
+	}
+}
+
+// GCCPUFraction returns a Trigger which fires when the garbage collector uses
+// the provided fraction of the process's available CPU time, such as 0.25 for
+// 25%, between one reading and the next. It depends on the "/cpu/classes/"
+// metrics of runtime/metrics, which are available in Go 1.20 and newer.
+func GCCPUFraction(fraction float64) *Trigger {
+	var prevTotal, prevGC float64
+	return &Trigger{
+		Name:      "gc_cpu_fraction",
+		Threshold: fraction,
+		Value: func() (float64, bool) {
+			samples := []metrics.Sample{{Name: metricCPUTotal}, {Name: metricCPUGC}}
+			metrics.Read(samples)
+			if samples[0].Value.Kind() != metrics.KindFloat64 || samples[1].Value.Kind() != metrics.KindFloat64 {
+				return 0, false
+			}
+			total, gc := samples[0].Value.Float64(), samples[1].Value.Float64()
+			first := prevTotal == 0
+			dTotal, dGC := total-prevTotal, gc-prevGC
+			prevTotal, prevGC = total, gc
+			if first || dTotal <= 0 {
+				return 0, false
+			}
+			return dGC / dTotal, true
+		},
+	}
+}
+
+// SchedLatencyP99 returns a Trigger which fires when the 99th percentile of
+// the time that goroutines spend waiting to run, between one reading and the
+// next, reaches d.
+func SchedLatencyP99(d time.Duration) *Trigger {
+	var prev []uint64
+	return &Trigger{
+		Name:      "sched_latency_p99",
+		Threshold: d.Seconds(),
+		Value: func() (float64, bool) {
+			samples := []metrics.Sample{{Name: metricSchedLatency}}
+			metrics.Read(samples)
+			if samples[0].Value.Kind() != metrics.KindFloat64Histogram {
+				return 0, false
+			}
+			hist := samples[0].Value.Float64Histogram()
+			counts := append([]uint64(nil), hist.Counts...)
+			first := prev == nil
+			delta := make([]uint64, len(counts))
+			for i := range counts {
+				delta[i] = counts[i]
+				if i < len(prev) {
+					delta[i] -= prev[i]
+				}
+			}
+			prev = counts
+			if first {
+				return 0, false
+			}
+			return quantile(delta, hist.Buckets, 0.99), true
+		},
+	}
+}
+
+// quantile returns an upper bound on the q-quantile of the histogram with the
+// provided bucket counts and boundaries, or zero if it is empty.
+func quantile(counts []uint64, buckets []float64, q float64) float64 {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q * float64(total)))
+	var sum uint64
+	for i, n := range counts {
+		sum += n
+		if sum < target {
+			continue
+		}
+		if v := buckets[i+1]; !math.IsInf(v, 1) {
+			return v
+		}
+		return buckets[i]
+	}
+	return buckets[len(buckets)-1]
+}
+
+// Expvar returns a Trigger which fires when the expvar variable with the
+// provided name reaches the threshold. The variable must hold a number, such
+// as an *expvar.Int or *expvar.Float.
+func Expvar(name string, threshold float64) *Trigger {
+	return &Trigger{
+		Name:      "expvar:" + name,
+		Threshold: threshold,
+		Value: func() (float64, bool) {
+			v := expvar.Get(name)
+			if v == nil {
+				return 0, false
+			}
+			f, err := strconv.ParseFloat(v.String(), 64)
+			if err != nil {
+				return 0, false
+			}
+			return f, true
+		},
+	}
+}
+
+// Predicate returns a Trigger with the provided name which fires when fn
+// returns true.
+func Predicate(name string, fn func() bool) *Trigger {
+	return &Trigger{
+		Name:      name,
+		Threshold: 1,
+		Value: func() (float64, bool) {
+			if fn() {
+				return 1, true
+			}
+			return 0, true
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package trigger
+
+import (
+	"expvar"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var testQueueDepth = expvar.NewInt("trigger-test-queue-depth")
+
+func TestTriggers(t *testing.T) {
+	testQueueDepth.Set(40)
+
+	for _, tt := range []struct {
+		tr     *Trigger
+		reads  int
+		wantOK bool
+		min    float64
+	}{
+		{tr: HeapInUse(1), reads: 1, wantOK: true, min: 1},
+		{tr: Goroutines(1), reads: 1, wantOK: true, min: 1},
+		{tr: Expvar("trigger-test-queue-depth", 32), reads: 1, wantOK: true, min: 40},
+		{tr: Expvar("trigger-test-missing", 32), reads: 1, wantOK: false},
+		{tr: Predicate("always", func() bool { return true }), reads: 1, wantOK: true, min: 1},
+		// These compute values from the change between readings.
+		{tr: SchedLatencyP99(time.Millisecond), reads: 1, wantOK: false},
+		{tr: SchedLatencyP99(time.Millisecond), reads: 2, wantOK: true, min: 0},
+	} {
+		var v float64
+		var ok bool
+		for i := 0; i < tt.reads; i++ {
+			runtime.Gosched()
+			v, ok = tt.tr.Value()
+		}
+		if ok != tt.wantOK {
+			t.Errorf("%s after %d reads; ok = %t, expected %t", tt.tr.Name, tt.reads, ok, tt.wantOK)
+			continue
+		}
+		if ok && v < tt.min {
+			t.Errorf("%s; value %g < %g", tt.tr.Name, v, tt.min)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	buckets := []float64{math.Inf(-1), 1, 2, 3, math.Inf(1)}
+	for _, tt := range []struct {
+		counts []uint64
+		q      float64
+		want   float64
+	}{
+		{[]uint64{0, 0, 0, 0}, 0.99, 0},
+		{[]uint64{0, 100, 0, 0}, 0.99, 2},
+		{[]uint64{0, 99, 1, 0}, 0.99, 2},
+		{[]uint64{0, 98, 2, 0}, 0.99, 3},
+		{[]uint64{0, 0, 0, 5}, 0.99, 3},
+	} {
+		if have := quantile(tt.counts, buckets, tt.q); have != tt.want {
+			t.Errorf("quantile(%v, %g); %g != %g", tt.counts, tt.q, have, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rhysh/autoprof"
+)
+
+// A Watcher checks its Triggers periodically, and collects a profile bundle
+// when one fires.
+type Watcher struct {
+	// Triggers lists the conditions to check. When more than one fires at the
+	// same time, the Watcher collects a single bundle for the first of them.
+	Triggers []*Trigger
+
+	// PollInterval is the time between checks of the Triggers. If zero, it
+	// defaults to one second.
+	PollInterval time.Duration
+	// Cooldown is the minimum time from a bundle that a Trigger prompts until
+	// that Trigger may prompt another. If zero, it defaults to ten minutes.
+	Cooldown time.Duration
+	// MaxPerHour limits the number of bundles that all of the Triggers
+	// together may prompt in any hour. If zero, it defaults to six. A negative
+	// value means no limit.
+	MaxPerHour int
+
+	// Options, if set, describes what to include in each bundle. A Watcher
+	// sets the RecordErrors field of its own copy. When Options is nil, it
+	// uses autoprof.DefaultArchiveOptions. Set the FlightRecorder field to
+	// include the execution trace from the moments before the Trigger fired.
+	Options *autoprof.ArchiveOptions
+
+	// Store receives each profile bundle.
+	Store autoprof.Store
+
+	// OnError, if set, receives each error from building or storing a bundle,
+	// and the Watcher continues. By default, Run returns the first such
+	// error.
+	OnError func(err error)
+}
+
+const (
+	defaultPollInterval = 1 * time.Second
+	defaultCooldown     = 10 * time.Minute
+	defaultMaxPerHour   = 6
+)
+
+var errNoStore = errors.New("trigger: no Store specified")
+
+// Run checks the Triggers until the context ends.
+func (w *Watcher) Run(ctx context.Context) error {
+	if w.Store == nil {
+		return errNoStore
+	}
+	pollInterval := w.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	ws := newWatchState(w)
+
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		now := time.Now()
+		tr, value := ws.check(now)
+		if tr == nil {
+			continue
+		}
+		ws.record(tr, now)
+
+		err := w.capture(ctx, tr, value)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if w.OnError == nil {
+				return err
+			}
+			w.OnError(err)
+		}
+	}
+}
+
+// capture collects a profile bundle on behalf of the trigger, and stores it.
+func (w *Watcher) capture(ctx context.Context, tr *Trigger, value float64) error {
+	meta := autoprof.CurrentArchiveMeta()
+	meta.Trigger = &autoprof.ArchiveTrigger{
+		Name:      tr.Name,
+		Value:     value,
+		Threshold: tr.Threshold,
+	}
+
+	opts := autoprof.DefaultArchiveOptions()
+	if w.Options != nil {
+		*opts = *w.Options
+		opts.RecordErrors = true
+	}
+
+	var buf bytes.Buffer
+	err := autoprof.NewZipCollector(&buf, meta, opts).Run(ctx)
+	if err != nil {
+		return fmt.Errorf("trigger %q: %w", tr.Name, err)
+	}
+	err = w.Store.Put(ctx, meta, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("trigger %q: store bundle: %w", tr.Name, err)
+	}
+	return nil
+}
+
+// watchState tracks the history of a Watcher's Triggers.
+type watchState struct {
+	w          *Watcher
+	cooldown   time.Duration
+	maxPerHour int
+
+	// fired records which triggers have fired and not yet dropped back below
+	// their thresholds.
+	fired map[*Trigger]bool
+	// last is when each trigger last prompted a bundle.
+	last map[*Trigger]time.Time
+	// recent lists when the bundles in the last hour began.
+	recent []time.Time
+}
+
+func newWatchState(w *Watcher) *watchState {
+	ws := &watchState{
+		w:          w,
+		cooldown:   w.Cooldown,
+		maxPerHour: w.MaxPerHour,
+		fired:      make(map[*Trigger]bool),
+		last:       make(map[*Trigger]time.Time),
+	}
+	if ws.cooldown <= 0 {
+		ws.cooldown = defaultCooldown
+	}
+	if ws.maxPerHour == 0 {
+		ws.maxPerHour = defaultMaxPerHour
+	}
+	return ws
+}
+
+// check reads each trigger's value, and returns the first that should prompt
+// a bundle along with its value, or nil if none should.
+func (ws *watchState) check(now time.Time) (*Trigger, float64) {
+	// Forget the bundles that no longer count against the hourly limit.
+	for len(ws.recent) > 0 && now.Sub(ws.recent[0]) >= time.Hour {
+		ws.recent = ws.recent[1:]
+	}
+	limited := ws.maxPerHour > 0 && len(ws.recent) >= ws.maxPerHour
+
+	var found *Trigger
+	var foundValue float64
+	for _, tr := range ws.w.Triggers {
+		// Read every trigger on every check, so those that compute rates see
+		// consistent intervals.
+		v, ok := tr.Value()
+		if !ok {
+			continue
+		}
+		if v < tr.Threshold {
+			ws.fired[tr] = false
+			continue
+		}
+		if found != nil || limited || ws.fired[tr] {
+			continue
+		}
+		if last, ok := ws.last[tr]; ok && now.Sub(last) < ws.cooldown {
+			continue
+		}
+		found, foundValue = tr, v
+	}
+	return found, foundValue
+}
+
+// record notes that the trigger prompted a bundle.
+func (ws *watchState) record(tr *Trigger, now time.Time) {
+	ws.fired[tr] = true
+	ws.last[tr] = now
+	ws.recent = append(ws.recent, now)
+}
@@ -0,0 +1,177 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rhysh/autoprof"
+	"github.com/rhysh/autoprof/bundle"
+)
+
+// memStore is an autoprof.Store that holds bundles in memory.
+type memStore struct {
+	mu      sync.Mutex
+	bundles map[string][]byte
+	puts    chan string
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		bundles: make(map[string][]byte),
+		puts:    make(chan string, 100),
+	}
+}
+
+func (s *memStore) Put(ctx context.Context, meta *autoprof.ArchiveMeta, buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := autoprof.BundleKey(meta)
+	s.bundles[key] = buf
+	s.puts <- key
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) ([]*autoprof.StoredBundle, error) {
+	return nil, nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.bundles[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return buf, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bundles, key)
+	return nil
+}
+
+func TestWatchState(t *testing.T) {
+	var a, b float64
+	ta := &Trigger{Name: "a", Threshold: 10, Value: func() (float64, bool) { return a, true }}
+	tb := &Trigger{Name: "b", Threshold: 10, Value: func() (float64, bool) { return b, true }}
+	ws := newWatchState(&Watcher{
+		Triggers:   []*Trigger{ta, tb},
+		Cooldown:   time.Minute,
+		MaxPerHour: 3,
+	})
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, step := range []struct {
+		at   time.Duration
+		a, b float64
+		want string
+	}{
+		{at: 0, a: 5, b: 5, want: ""},
+		{at: 1 * time.Second, a: 15, b: 15, want: "a"},
+		// Each trigger fires once per crossing.
+		{at: 2 * time.Second, a: 15, b: 15, want: "b"},
+		{at: 3 * time.Second, a: 15, b: 15, want: ""},
+		// Dropping below the threshold re-arms the trigger, but it must wait
+		// for the cooldown.
+		{at: 4 * time.Second, a: 5, b: 15, want: ""},
+		{at: 5 * time.Second, a: 15, b: 15, want: ""},
+		{at: 61 * time.Second, a: 15, b: 15, want: "a"},
+		// The hourly limit applies to all triggers together.
+		{at: 62 * time.Second, a: 5, b: 5, want: ""},
+		{at: 200 * time.Second, a: 15, b: 15, want: ""},
+		{at: 61 * time.Minute, a: 15, b: 15, want: "a"},
+	} {
+		a, b = step.a, step.b
+		now := start.Add(step.at)
+		tr, v := ws.check(now)
+		var have string
+		if tr != nil {
+			have = tr.Name
+			ws.record(tr, now)
+			if v != 15 {
+				t.Errorf("at %s; value %g != 15", step.at, v)
+			}
+		}
+		if have != step.want {
+			t.Errorf("at %s; fired %q, expected %q", step.at, have, step.want)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	unhealthy := false
+	store := newMemStore()
+	w := &Watcher{
+		Triggers: []*Trigger{
+			Predicate("unhealthy", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return unhealthy
+			}),
+		},
+		PollInterval: time.Millisecond,
+		Options:      &autoprof.ArchiveOptions{IncludeProfiles: []string{"heap"}},
+		Store:        store,
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- w.Run(ctx) }()
+
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case key := <-store.puts:
+		t.Fatalf("stored %q before the trigger fired", key)
+	default:
+	}
+
+	mu.Lock()
+	unhealthy = true
+	mu.Unlock()
+
+	var key string
+	select {
+	case key = <-store.puts:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("trigger did not prompt a bundle")
+	}
+	cancel()
+	<-errs
+
+	buf, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get; err = %v", err)
+	}
+	b, err := bundle.Open(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("bundle.Open; err = %v", err)
+	}
+	if b.Meta.Trigger == nil {
+		t.Fatalf("meta; no trigger")
+	}
+	if have, want := *b.Meta.Trigger, (autoprof.ArchiveTrigger{Name: "unhealthy", Value: 1, Threshold: 1}); have != want {
+		t.Errorf("meta trigger; %#v != %#v", have, want)
+	}
+}
+
+func TestWatcherNoStore(t *testing.T) {
+	w := &Watcher{
+		Triggers:     []*Trigger{Predicate("always", func() bool { return true })},
+		PollInterval: time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := w.Run(ctx)
+	if !errors.Is(err, errNoStore) {
+		t.Errorf("Run; err = %v, expected %v", err, errNoStore)
+	}
+}
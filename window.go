@@ -0,0 +1,47 @@
+package autoprof
+
+import (
+	"strconv"
+	"time"
+)
+
+// A ProfileWindow is a CPU profile that was collected outside of a Collector,
+// such as by a continuous profiler that runs back-to-back profiles, for
+// inclusion in a later profile bundle.
+type ProfileWindow struct {
+	// Start and End are when the CPU profile started and stopped.
+	Start time.Time
+	End   time.Time
+	// RequestedDuration is how long the profile was supposed to run, and
+	// StopReason describes why it stopped.
+	RequestedDuration time.Duration
+	StopReason        StopReason
+	// Profile is the protobuf-encoded CPU profile, as
+	// runtime/pprof.StartCPUProfile writes it.
+	Profile []byte
+}
+
+// addCPUProfileWindows writes each of the CPU profile windows into the profile
+// bundle, with manifest entries that describe the windows rather than the
+// time the collector spent copying them.
+func (c *Collector) addCPUProfileWindows() {
+	for i, win := range c.opt.CPUProfileWindows {
+		if c.addErr != nil {
+			return
+		}
+		w, err := c.createEntry("pprof-windows/" + strconv.Itoa(i))
+		if err != nil {
+			c.addErr = err
+			return
+		}
+		_, err = w.Write(win.Profile)
+		if err != nil {
+			c.addErr = err
+			return
+		}
+		w.rec.Start = win.Start
+		w.rec.End = win.End
+		w.rec.RequestedDuration = win.RequestedDuration
+		w.rec.StopReason = win.StopReason
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"expvar"
 	"fmt"
 	"io"
+	"runtime/debug"
 	"runtime/pprof"
 )
 
@@ -16,7 +17,11 @@ func errSource(err error) *DataSource {
 }
 
 func metaSource(meta *ArchiveMeta) *DataSource {
-	buf, err := json.Marshal(meta)
+	return jsonSource(meta)
+}
+
+func jsonSource(v interface{}) *DataSource {
+	buf, err := json.Marshal(v)
 	if err != nil {
 		return errSource(err)
 	}
@@ -30,6 +35,21 @@ func metaSource(meta *ArchiveMeta) *DataSource {
 	}}
 }
 
+// buildInfoSource returns a DataSource that writes the program's build
+// information, including its module dependencies, in the format of
+// runtime/debug.BuildInfo.String. It returns nil if the build information is
+// not available.
+func buildInfoSource() *DataSource {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	return &DataSource{WriteTo: func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, info.String())
+		return err
+	}}
+}
+
 func expvarSource() *DataSource {
 	return expvarStyleSource(expvar.Do)
 }
@@ -55,8 +75,8 @@ func expvarStyleSource(do func(func(kv expvar.KeyValue))) *DataSource {
 	}}
 }
 
-func pprofSource(profile *pprof.Profile) *DataSource {
+func pprofSource(profile *pprof.Profile, debug int) *DataSource {
 	return &DataSource{WriteTo: func(ctx context.Context, w io.Writer) error {
-		return profile.WriteTo(w, 0)
+		return profile.WriteTo(w, debug)
 	}}
 }